@@ -0,0 +1,102 @@
+package api
+
+import (
+	"sort"
+
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+// 分析过程中输出给前端的事件类型
+const (
+	// EventDiff 需要更新的商品，data 为 goodUpdated
+	EventDiff = "diff"
+	// EventMissingItemNo 有赞商品没有设置商品编码
+	EventMissingItemNo = "missing_item_no"
+	// EventUnmatchedItem 库存文件里的商品编码在有赞里找不到
+	EventUnmatchedItem = "unmatched_item"
+	// EventUnmatchedSku 库存文件里的 sku 编码或规格组合在有赞商品里找不到
+	EventUnmatchedSku = "unmatched_sku"
+	// EventUnknownStore 库存文件里的门店在有赞里找不到
+	EventUnknownStore = "unknown_store"
+	// EventStoreMismatch 库存文件里的门店 ID 和门店名称不一致，或者门店 ID 不存在而按名称匹配
+	EventStoreMismatch = "store_mismatch"
+	// EventInvalidSku 有赞 sku 的规格、价格或库存无法解析
+	EventInvalidSku = "invalid_sku"
+	// EventCheckFailed 有赞商品的 sku 设置不正确，无法判断是否需要更新
+	EventCheckFailed = "check_failed"
+	// EventYouzanError 获取有赞商品详情失败
+	EventYouzanError = "youzan_error"
+	// EventProgress 请求有赞的进度和剩余配额
+	EventProgress = "progress"
+	// EventError 分析失败、超时或被取消
+	EventError = "error"
+	// EventDone 分析结束，data 为 analysisSummary
+	EventDone = "done"
+)
+
+type analysisEvent struct {
+	ID   int         `json:"id"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// analysisFailure EventError 的 data
+type analysisFailure struct {
+	Msg string `json:"msg"`
+}
+
+// analysisProblem 分析时被跳过的商品、行或 sku，门店负责人可以据此修正数据
+type analysisProblem struct {
+	ItemID    int64         `json:"item_id,omitempty"`
+	ItemTitle string        `json:"item_title,omitempty"`
+	ItemNo    string        `json:"item_no,omitempty"`
+	OfflineID string        `json:"offline_id,omitempty"`
+	ShopName  string        `json:"shop_name,omitempty"`
+	SkuID     int64         `json:"sku_id,omitempty"`
+	Msg       string        `json:"msg"`
+	Error     *youzan.Error `json:"error,omitempty"`
+	// Suggestions 门店匹配不到时可能对应的有赞门店
+	Suggestions []*storeSuggestion `json:"suggestions,omitempty"`
+}
+
+// analysisSummary 分析结束时按事件类型汇总
+type analysisSummary struct {
+	Tasks         int            `json:"tasks"`
+	Updated       int            `json:"updated"`
+	Problems      map[string]int `json:"problems"`
+	UnknownStores []string       `json:"unknown_stores"`
+	unknownStores map[string]bool
+}
+
+func newAnalysisSummary(tasks int) *analysisSummary {
+	return &analysisSummary{
+		Tasks:         tasks,
+		Problems:      make(map[string]int),
+		UnknownStores: make([]string, 0),
+		unknownStores: make(map[string]bool),
+	}
+}
+
+func (s *analysisSummary) Add(e *analysisEvent) {
+	switch e.Type {
+	case EventDiff:
+		s.Updated++
+		return
+	case EventProgress, EventError, EventDone:
+		return
+	}
+	s.Problems[e.Type]++
+	problem, ok := e.Data.(*analysisProblem)
+	if !ok || e.Type != EventUnknownStore {
+		return
+	}
+	store := problem.ShopName
+	if store == "" {
+		store = problem.OfflineID
+	}
+	if !s.unknownStores[store] {
+		s.unknownStores[store] = true
+		s.UnknownStores = append(s.UnknownStores, store)
+		sort.Strings(s.UnknownStores)
+	}
+}
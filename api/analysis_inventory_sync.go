@@ -1,9 +1,9 @@
 package api
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"strconv"
 	"strings"
 	"time"
@@ -15,205 +15,451 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// analysisTimeout 一次分析最长的时间
+	analysisTimeout = time.Hour
+	// resumeGrace 所有客户端断开后等待重连的时间，超过后取消分析
+	resumeGrace = time.Minute
+)
+
+type emitFunc func(eventType string, data interface{})
+
+// analysisConfig 一次分析使用的规则，开始分析时读取，分析过程中修改配置不影响这次分析
+type analysisConfig struct {
+	compare    *CompareRules
+	transforms TransformRules
+	guardrails *GuardrailPolicy
+}
+
+// AnalysisInventorySync 以 Server-Sent Events 输出 job 的分析事件
+// 还没分析过的 job 会开始分析；带 Last-Event-ID 重连时从断开的地方继续，不会重新请求有赞
+// restart=true 时重新分析已经结束的 job；EventSource 断线重连会带着 Last-Event-ID 请求同一个地址，这时忽略 restart
 func (a *Api) AnalysisInventorySync(c *gin.Context) {
-	if InventorySyncTaskCache == nil {
-		RespErr(c, nil, "还没有上传库存文件")
+	job, err := a.jobs.Get(c.Param("id"))
+	if err != nil {
+		RespErr(c, err, "任务不存在")
 		return
 	}
+	lastID := lastEventID(c)
+	status := job.CurrentStatus()
+	restart := c.Query("restart") == "true" && c.Request.Header.Get("Last-Event-ID") == ""
+	if status == JobStatusInit || (restart && status != JobStatusParsing) {
+		if err := a.startAnalysis(job); err != nil && err != ErrJobRunning {
+			RespErr(c, err)
+			return
+		}
+		lastID = 0
+	}
+	a.streamJobEvents(c, job, lastID)
+}
 
-	c.Writer.Header().Set("Content-Type", "text/event-strem")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Header().Set("X-Accel-Buffering", "no")
+func (a *Api) startAnalysis(job *Job) error {
+	ctx, err := job.Start(context.Background(), analysisTimeout)
+	if err != nil {
+		return err
+	}
+	go a.runAnalysis(ctx, job)
+	return nil
+}
+
+// streamJobEvents 输出 lastID 之后的事件，直到分析结束或客户端断开
+func (a *Api) streamJobEvents(c *gin.Context, job *Job, lastID int) {
+	events := job.Events()
+	job.Subscribe()
+	defer job.Unsubscribe(resumeGrace)
+
+	setSSEHeaders(c)
+	writeSSEPing(c.Writer)
+	ctx := c.Request.Context()
+	for {
+		list, changed, closed := events.Since(lastID)
+		for _, e := range list {
+			if err := writeSSE(c.Writer, e); err != nil {
+				logrus.Errorf("write event %d of job %s failed: %v", e.ID, job.ID, err)
+				return
+			}
+			lastID = e.ID
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 30):
+			writeSSEPing(c.Writer)
+		}
+	}
+}
+
+// runAnalysis 对比库存文件和有赞商品，事件输出到 job 里，和客户端连接无关
+func (a *Api) runAnalysis(ctx context.Context, job *Job) {
+	fail := func(status string, err error) {
+		logrus.Errorf("job %s %s: %v", job.ID, status, err)
+		job.Emit(EventError, &analysisFailure{Msg: err.Error()})
+		job.Finish(status, err)
+	}
+	summary := newAnalysisSummary(0)
+	emit := func(eventType string, data interface{}) {
+		summary.Add(job.Emit(eventType, data))
+	}
 
-	itemsHash := InventorySyncTaskCache.ItemsHash
 	// 获取所有门店
-	offlines, err := youzan.QueryOfflines()
+	offlines, err := a.youzan.QueryOfflines(ctx)
 	if err != nil {
-		RespErr(c, err, "获取 offlines 失败")
+		fail(JobStatusFailed, fmt.Errorf("获取 offlines 失败: %v", err))
 		return
 	}
 	// 获取所有有赞商品
-	items, err := youzan.QueryItems()
+	items, err := a.youzan.QueryItems(ctx)
 	if err != nil {
-		RespErr(c, err)
+		fail(JobStatusFailed, fmt.Errorf("获取有赞商品失败: %v", err))
 		return
 	}
 	logrus.Debugf("items: %d", len(items))
 
-	tasks := make([]*limitedRequest.Task, 0)
-	for _, item := range items {
-		if item.ItemNO == "" {
-			logrus.Debugf("items (%s) has no item_no", item.Title)
-			continue
-		}
-		// 到 excel 里找 item.ItemNo 对应的所有条目
-		itemsExcel, ok := itemsHash[item.ItemNO]
-		if !ok {
-			logrus.Debugf("itemsExcel %s (%s) no found", item.ItemNO, item.Title)
-			continue
-		}
-		for _, itemExcel := range itemsExcel {
-			offlineID, err := offlines.GetIDByName(itemExcel.ShopName)
-			if err != nil {
-				logrus.Errorf("有赞里没有门店[%s]", itemExcel.ShopName)
-				continue
-			}
-			itemID := fmt.Sprintf("%d", item.ItemID)
-			tasks = append(tasks, &limitedRequest.Task{
-				ID:     fmt.Sprintf("%s-%s", itemID, offlineID),
-				URL:    "https://open.youzan.com/api/oauthentry/youzan.multistore.goods.sku/3.0.0/get",
-				Method: "GET",
-				Temp: map[string]interface{}{
-					"excelRow": itemExcel,
-				},
-				Params: map[string]string{
-					"num_iid":      itemID,
-					"offline_id":   offlineID,
-					"access_token": youzan.AccessToken,
-				},
-			})
-		}
+	// 没有商品编码的行按 sku 编码找到所属的有赞商品
+	skuItems := a.resolveSkuRows(ctx, job.SkuRows, emit)
+	if ctx.Err() != nil {
+		stopped(ctx, fail)
+		return
 	}
 
+	tasks := a.buildGoodsTasks(job, items, skuItems, offlines, emit)
+	cfg := &analysisConfig{
+		compare:    a.compareRules.Get(),
+		transforms: a.transformRules.Get(),
+		guardrails: a.guardrails.Get(),
+	}
 	totalTaskNum := len(tasks)
+	summary.Tasks = totalTaskNum
 
 	logrus.Infof("===== Start to fetch goods from youzan. ====")
 
-	lreq := limitedRequest.New(&limitedRequest.Options{
-		RequestThresholdPerSecond: 3,
-	})
-
-	pingStr := fmt.Sprintf("%x\r\nping", len("ping"))
-	io.WriteString(c.Writer, pingStr)
-	c.Writer.Flush()
+	lreq := a.newYouzanRequest()
 
-	var (
-		g              errgroup.Group
-		finishedTaskCh = make(chan *limitedRequest.Task)
-		outputCh       = make(chan *goodUpdated)
-	)
+	var g errgroup.Group
 	done := make(chan struct{})
-	notify := c.Writer.CloseNotify()
 
 	g.Go(func() error {
+		ticker := time.NewTicker(time.Second * 2)
+		defer ticker.Stop()
+		lastFinished := -1
 		for {
-			logrus.Infof("%s, total: %d", lreq.Status(), totalTaskNum)
-			if lreq.FinishedCount() == totalTaskNum {
-				close(done)
+			status := lreq.Status()
+			logrus.Infof("%s, total: %d", status, totalTaskNum)
+			if status.Finished != lastFinished {
+				lastFinished = status.Finished
+				emit(EventProgress, status)
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return nil
+			case <-ctx.Done():
 				return nil
 			}
-			time.Sleep(time.Second)
 		}
 	})
 	g.Go(func() error {
-		for {
-			task := <-finishedTaskCh
-			logrus.Debugf("task %s finished", task.ID)
-			parts := strings.Split(task.ID, "-")
-			offlineID := parts[1]
-			gd := parseGoodsDetail(task.Body)
-			if gd == nil {
-				logrus.Errorf("parseGoodsDetail get nil")
-				continue
-			}
-			excelRow, ok := task.Temp["excelRow"].(*ExcelRow)
-			if !ok {
-				logrus.Errorf("convert task.Temp[excelRow] to *ExcelRow failed")
-				continue
-			}
-			need, err := needYouzanGoodToBeUpdated(excelRow, gd)
-			if err != nil {
-				logrus.Errorf("needYouzanGoodToBeUpdated failed: %v", err)
-			}
-			if !need {
-				logrus.Debugf("no need update")
-				continue
-			}
-			offlineIDD, _ := strconv.ParseInt(offlineID, 10, 64)
-			numIIDD, _ := strconv.ParseInt(gd.NumIID, 10, 64)
-
-			skus := make([]*goodUpdatedSku, 0)
-			for _, sku := range gd.Skus {
-				properties, err := sku.FormatProperties()
-				if err != nil {
-					logrus.Errorf("解析 properties_name_json 出错: %v", err)
-					continue
-				}
-				if len(properties) != 1 {
-					logrus.Errorf("商品 [%d][%s] 的规格不唯一", gd.NumIID, gd.Title)
-					continue
-				}
-				property := properties[0]
-
-				skus = append(skus, &goodUpdatedSku{
-					ID:         sku.SkuID,
-					K:          property.K,
-					V:          property.V,
-					Price:      sku.Price,
-					Quantity:   sku.Quantity,
-					ToPrice:    excelRow.Price,
-					ToQuantity: excelRow.Quantity,
-				})
-			}
-			gu := &goodUpdated{
-				ItemID:      numIIDD,
-				ItemTitle:   gd.Title,
-				ItemNo:      gd.OuterID,
-				OfflineID:   offlineIDD,
-				OfflineName: excelRow.ShopName,
-				Skus:        skus,
+		defer lreq.Stop()
+		results := lreq.Results()
+		// 所有 task 的结果都输出后才结束
+		for processed := 0; processed < totalTaskNum; processed++ {
+			select {
+			case task := <-results:
+				a.processGoodsTask(task, cfg, emit)
+			case <-ctx.Done():
+				return nil
 			}
-			logrus.Debugf("append to chan output: %+v", gu)
-			outputCh <- gu
 		}
+		close(done)
+		return nil
 	})
-
 	g.Go(func() error {
 		logrus.Debugf("tasks 总数 %d", len(tasks))
-		lreq.Add(tasks)
+		lreq.Add(ctx, tasks)
 		return nil
 	})
 	g.Go(func() error {
-		err := lreq.Start()
+		err := lreq.Start(ctx)
 		logrus.Debugf("LimitedRequest ended with err: %v", err)
-		return err
+		return nil
 	})
+	g.Wait()
 
-	g.Go(func() error {
-		results := lreq.Results()
-		for {
-			select {
-			case <-time.After(time.Hour):
-				io.WriteString(c.Writer, fmt.Sprintf("%x\r\n%s", len("timeout"), "timeout"))
-				c.Writer.Flush()
-				lreq.Stop()
-				return nil
-			case <-done:
-				io.WriteString(c.Writer, fmt.Sprintf("%x\r\n%s", len("eof"), "eof"))
-				c.Writer.Flush()
-				lreq.Stop()
-				return nil
-			case <-notify:
-				lreq.Stop()
-				return nil
-			case out := <-outputCh:
-				b, _ := json.Marshal(out)
-				s := string(b)
-				logrus.Debugf("repsonse write: %s", s)
-				io.WriteString(c.Writer, fmt.Sprintf("%x\r\n%s", len(s), s))
-				c.Writer.Flush()
-			case <-time.After(time.Second * 30):
-				io.WriteString(c.Writer, pingStr)
-				c.Writer.Flush()
-			case task := <-results:
-				finishedTaskCh <- task
+	select {
+	case <-done:
+		job.RLock()
+		results := job.Results
+		job.RUnlock()
+		for _, v := range cfg.guardrails.checkResults(results) {
+			emit(EventGuardrail, v)
+		}
+		emit(EventDone, summary)
+		job.Finish(JobStatusParsed, nil)
+	default:
+		stopped(ctx, fail)
+	}
+}
+
+// stopped 分析因为超时或取消没有完成
+func stopped(ctx context.Context, fail func(status string, err error)) {
+	if ctx.Err() == context.DeadlineExceeded {
+		fail(JobStatusFailed, errors.New("timeout"))
+		return
+	}
+	fail(JobStatusCanceled, errors.New("分析已取消"))
+}
+
+// buildGoodsTasks 为库存文件里每个商品、门店生成获取有赞门店商品详情的 task
+// skuItems 为按 sku 编码找到商品的行，key 为有赞商品 ID
+func (a *Api) buildGoodsTasks(job *Job, items []*youzan.Item, skuItems map[int64][]*ExcelRow, offlines *youzan.Offlines, emit emitFunc) []*limitedRequest.Task {
+	matchedItemNos := make(map[string]bool)
+	matchedItemIDs := make(map[int64]bool)
+	tasks := make([]*limitedRequest.Task, 0)
+	for _, item := range items {
+		itemsExcel := skuItems[item.ItemID]
+		matchedItemIDs[item.ItemID] = true
+		if item.ItemNO == "" {
+			if len(itemsExcel) == 0 {
+				logrus.Debugf("items (%s) has no item_no", item.Title)
+				emit(EventMissingItemNo, &analysisProblem{
+					ItemID:    item.ItemID,
+					ItemTitle: item.Title,
+					Msg:       "有赞商品没有设置商品编码",
+				})
+				continue
 			}
+		} else if rows, ok := job.ItemsHash[item.ItemNO]; ok {
+			// 到 excel 里找 item.ItemNo 对应的所有条目
+			matchedItemNos[item.ItemNO] = true
+			itemsExcel = append(append([]*ExcelRow{}, rows...), itemsExcel...)
 		}
-	})
+		if len(itemsExcel) == 0 {
+			logrus.Debugf("itemsExcel %s (%s) no found", item.ItemNO, item.Title)
+			continue
+		}
+		// 同一个门店的多行（不同 sku）合并到一个 task
+		storeTasks := make(map[string]*limitedRequest.Task)
+		for _, itemExcel := range itemsExcel {
+			store, err := matchStore(offlines, a.aliases, itemExcel)
+			if err != nil {
+				logrus.Errorf("%v", err)
+				emit(EventUnknownStore, &analysisProblem{
+					ItemID:      item.ItemID,
+					ItemTitle:   item.Title,
+					ItemNo:      item.ItemNO,
+					OfflineID:   itemExcel.OfflineID,
+					ShopName:    itemExcel.ShopName,
+					Msg:         err.Error(),
+					Suggestions: suggestStores(offlines, itemExcel.ShopName, 3),
+				})
+				continue
+			}
+			if store.Mismatch != "" {
+				emit(EventStoreMismatch, &analysisProblem{
+					ItemID:    item.ItemID,
+					ItemTitle: item.Title,
+					ItemNo:    item.ItemNO,
+					OfflineID: store.OfflineID,
+					ShopName:  itemExcel.ShopName,
+					Msg:       store.Mismatch,
+				})
+			}
+			offlineID := store.OfflineID
+			if task, ok := storeTasks[offlineID]; ok {
+				task.Temp["excelRows"] = append(task.Temp["excelRows"].([]*ExcelRow), itemExcel)
+				continue
+			}
+			itemID := fmt.Sprintf("%d", item.ItemID)
+			task := &limitedRequest.Task{
+				ID:     fmt.Sprintf("%s-%s", itemID, offlineID),
+				URL:    a.youzan.URL("youzan.multistore.goods.sku", "3.0.0", "get"),
+				Method: "GET",
+				Temp: map[string]interface{}{
+					"excelRows":   []*ExcelRow{itemExcel},
+					"item":        item,
+					"offlineName": store.Name,
+				},
+				Params: map[string]string{
+					"num_iid":    itemID,
+					"offline_id": offlineID,
+				},
+			}
+			storeTasks[offlineID] = task
+			tasks = append(tasks, task)
+		}
+	}
+	for itemNo, rows := range job.ItemsHash {
+		if matchedItemNos[itemNo] {
+			continue
+		}
+		for _, row := range rows {
+			emit(EventUnmatchedItem, &analysisProblem{
+				ItemNo:    itemNo,
+				OfflineID: row.OfflineID,
+				ShopName:  row.ShopName,
+				Msg:       fmt.Sprintf("有赞里没有商品编码为[%s]的商品", itemNo),
+			})
+		}
+	}
+	// sku 所属的商品不在出售中和仓库中的商品列表里
+	for itemID, rows := range skuItems {
+		if matchedItemIDs[itemID] {
+			continue
+		}
+		for _, row := range rows {
+			emit(EventUnmatchedItem, &analysisProblem{
+				ItemID:    itemID,
+				OfflineID: row.OfflineID,
+				ShopName:  row.ShopName,
+				Msg:       fmt.Sprintf("sku 编码[%s]所属的有赞商品不在出售中或仓库中", row.SkuNO),
+			})
+		}
+	}
+	return tasks
+}
+
+// processGoodsTask 对比一个门店商品的有赞详情和库存文件，按 skuRowMatcher 为每个 sku 找对应的行
+// 输出需要更新的 sku 或者问题
+func (a *Api) processGoodsTask(task *limitedRequest.Task, cfg *analysisConfig, emit emitFunc) {
+	logrus.Debugf("task %s finished", task.ID)
+	parts := strings.Split(task.ID, "-")
+	offlineID := parts[1]
+	excelRows, ok := task.Temp["excelRows"].([]*ExcelRow)
+	if !ok {
+		logrus.Errorf("convert task.Temp[excelRows] to []*ExcelRow failed")
+		return
+	}
+	item := task.Temp["item"].(*youzan.Item)
+	offlineName := task.Temp["offlineName"].(string)
+	problem := func(msg string) *analysisProblem {
+		return &analysisProblem{
+			ItemID:    item.ItemID,
+			ItemTitle: item.Title,
+			ItemNo:    item.ItemNO,
+			OfflineID: offlineID,
+			ShopName:  offlineName,
+			Msg:       msg,
+		}
+	}
+	if task.Err != nil {
+		logrus.Errorf("task %s failed after %d attempts: %v", task.ID, task.Attempts, task.Err)
+		emit(EventYouzanError, newYouzanProblem(problem(task.Err.Error()), task.Err))
+		return
+	}
+	gd, invalid, err := parseGoodsDetail(task.Body)
+	if err != nil {
+		logrus.Errorf("task %s parseGoodsDetail failed: %v", task.ID, err)
+		emit(EventYouzanError, newYouzanProblem(problem(err.Error()), err))
+		return
+	}
+	if len(gd.Skus)+len(invalid) <= 0 {
+		emit(EventCheckFailed, problem(fmt.Sprintf("有赞商品 [%s] 没有设置 sku", gd.Title)))
+		return
+	}
+	matcher := newSkuRowMatcher(excelRows)
+	// 价格或库存无法解析的 sku 不参与对比，避免按 0 生成错误的更新，对应的行也不再报告为找不到 sku
+	for _, e := range invalid {
+		properties, _ := e.Sku.FormatProperties()
+		matcher.Match(e.Sku, properties)
+		p := problem(e.Msg)
+		p.SkuID = e.Sku.SkuID
+		emit(EventInvalidSku, p)
+	}
+	rule := cfg.compare.For(offlineID, offlineName)
+	transform := cfg.transforms.For(offlineID, offlineName, item)
+
+	offlineIDD, _ := strconv.ParseInt(offlineID, 10, 64)
+	numIIDD, _ := strconv.ParseInt(gd.NumIID, 10, 64)
 
-	if err := g.Wait(); err != nil {
-		RespErr(c, err)
+	skus := make([]*goodUpdatedSku, 0)
+	for _, sku := range gd.Skus {
+		properties, err := sku.FormatProperties()
+		if err != nil {
+			logrus.Errorf("解析 properties_name_json 出错: %v", err)
+			p := problem(fmt.Sprintf("解析 sku 规格出错: %v", err))
+			p.SkuID = sku.SkuID
+			emit(EventInvalidSku, p)
+			continue
+		}
+		excelRow := matcher.Match(sku, properties)
+		if excelRow == nil {
+			continue
+		}
+		published := excelRow
+		if transform != nil {
+			published = transform.Apply(excelRow)
+		}
+		change := rule.Compare(published, sku)
+		if change == nil {
+			continue
+		}
+		ks := make([]string, 0, len(properties))
+		vs := make([]string, 0, len(properties))
+		for _, p := range properties {
+			ks = append(ks, p.K)
+			vs = append(vs, p.V)
+		}
+		updated := &goodUpdatedSku{
+			ID:          sku.SkuID,
+			OuterID:     sku.OuterID,
+			K:           strings.Join(ks, "/"),
+			V:           strings.Join(vs, "/"),
+			Name:        propertiesLabel(properties),
+			Properties:  properties,
+			Price:       sku.Price,
+			Quantity:    sku.Quantity,
+			ToPrice:     change.ToPrice,
+			ToQuantity:  change.ToQuantity,
+			Changed:     change.Changed,
+			RawPrice:    excelRow.Price,
+			RawQuantity: excelRow.Quantity,
+		}
+		if violations := cfg.guardrails.checkSku(updated, excelRow.Cost); len(violations) > 0 {
+			updated.NeedsApproval = true
+			updated.Violations = violations
+		}
+		skus = append(skus, updated)
 	}
+	for _, row := range matcher.Unmatched() {
+		msg := fmt.Sprintf("有赞商品 [%s] 没有 sku 编码为[%s]的 sku", gd.Title, row.SkuNO)
+		if row.SkuNO == "" {
+			msg = fmt.Sprintf("有赞商品 [%s] 没有规格为[%s]的 sku", gd.Title, row.propertyKey())
+		}
+		emit(EventUnmatchedSku, problem(msg))
+	}
+	if len(skus) == 0 {
+		logrus.Debugf("no need update")
+		return
+	}
+	gu := &goodUpdated{
+		ItemID:      numIIDD,
+		ItemTitle:   gd.Title,
+		ItemNo:      gd.OuterID,
+		OfflineID:   offlineIDD,
+		OfflineName: offlineName,
+		Skus:        skus,
+		Rule:        rule.Name,
+		Transform:   transformName(transform),
+	}
+	logrus.Debugf("append to chan output: %+v", gu)
+	emit(EventDiff, gu)
+}
 
+func transformName(r *TransformRule) string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
+// newYouzanProblem 有赞返回了 error_response 时附上错误详情
+func newYouzanProblem(problem *analysisProblem, err error) *analysisProblem {
+	if ye, ok := err.(*youzan.Error); ok {
+		problem.Error = ye
+	}
+	return problem
 }
@@ -1,23 +1,85 @@
 package api
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	limitedRequest "github.com/xuyuntech/inventory_sync_go/limited_request"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
 )
 
-var InventorySyncTaskCache *InventorySyncTask
-
-type InventorySyncTask struct {
-	Status    string
-	ItemsHash map[string][]*ExcelRow
+type Options struct {
+	Youzan *youzan.Client
+	// Limiter 所有调用有赞接口的任务共用的速率和配额限制，默认每秒 3 次
+	Limiter *limitedRequest.Limiter
+	// MaxInFlight 每个任务同时进行中的有赞请求数上限
+	MaxInFlight int
+	// DataDir 列映射、门店别名、对比和转换规则等配置的保存目录
+	DataDir string
+	// Approvers 可以审批 sku 和修改检查规则的 access token，值为审批人名称
+	Approvers map[string]string
+	// PlanSecret 修改计划的签名密钥，为空时不签名
+	PlanSecret string
+	// JobTTL、MaxJobs 内存中保留 job 的时间和数量，默认 DefaultJobTTL 和 DefaultMaxJobs
+	JobTTL  time.Duration
+	MaxJobs int
 }
 
-type Api struct{}
+type Api struct {
+	jobs           *JobStore
+	youzan         *youzan.Client
+	limiter        *limitedRequest.Limiter
+	maxInFlight    int
+	profiles       *ProfileStore
+	aliases        *AliasStore
+	compareRules   *CompareRuleStore
+	transformRules *TransformRuleStore
+	guardrails     *GuardrailStore
+	approvers      map[string]string
+	planSecret     string
+}
 
-func New() *Api {
-	return &Api{}
+func New(opt *Options) (*Api, error) {
+	limiter := opt.Limiter
+	if limiter == nil {
+		limiter = limitedRequest.NewLimiter(3, 3)
+	}
+	profiles, err := NewProfileStore(opt.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := NewAliasStore(opt.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	compareRules, err := NewCompareRuleStore(opt.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	transformRules, err := NewTransformRuleStore(opt.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	guardrails, err := NewGuardrailStore(opt.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Api{
+		jobs:           NewJobStore(opt.JobTTL, opt.MaxJobs),
+		youzan:         opt.Youzan,
+		limiter:        limiter,
+		maxInFlight:    opt.MaxInFlight,
+		profiles:       profiles,
+		aliases:        aliases,
+		compareRules:   compareRules,
+		transformRules: transformRules,
+		guardrails:     guardrails,
+		approvers:      opt.Approvers,
+		planSecret:     opt.PlanSecret,
+	}, nil
 }
 
 func (a *Api) Run() error {
@@ -25,17 +87,73 @@ func (a *Api) Run() error {
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 	r.Use(cors.New(cors.Config{
-		AllowMethods:     []string{"GET", "POST", "PUT", "HEAD"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "HEAD"},
 		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "X-Requested-With", "X-Access-Token"},
 		AllowCredentials: false,
 		AllowAllOrigins:  true,
 		MaxAge:           12 * time.Hour,
 	}))
 	r.POST("/upload", a.Upload)
-	r.GET("/inventorySync/parsing", a.AnalysisInventorySync)
+	r.GET("/jobs", a.ListJobs)
+	r.GET("/jobs/:id", a.GetJob)
+	r.GET("/jobs/:id/parsing", a.AnalysisInventorySync)
+	r.POST("/jobs/:id/apply", a.ApplyInventorySync)
+	r.GET("/jobs/:id/ws", a.JobWebsocket)
+	r.GET("/profiles", a.ListProfiles)
+	r.GET("/profiles/:name", a.GetProfile)
+	r.PUT("/profiles/:name", a.SaveProfile)
+	r.DELETE("/profiles/:name", a.DeleteProfile)
+	r.GET("/store-aliases", a.ListStoreAliases)
+	r.POST("/store-aliases", a.SaveStoreAlias)
+	r.DELETE("/store-aliases/:name", a.DeleteStoreAlias)
+	r.GET("/store-suggestions", a.StoreSuggestions)
+	r.GET("/compare-rules", a.GetCompareRules)
+	r.PUT("/compare-rules", a.SaveCompareRules)
+	r.GET("/transform-rules", a.GetTransformRules)
+	r.PUT("/transform-rules", a.SaveTransformRules)
+	r.GET("/guardrails", a.GetGuardrails)
+	r.PUT("/guardrails", a.SaveGuardrails)
+	r.POST("/jobs/:id/approve", a.ApproveJob)
+	r.POST("/jobs/:id/plan", a.CreatePlan)
+	r.GET("/jobs/:id/plan", a.GetPlan)
+	r.POST("/jobs/:id/plan/apply", a.ApplyPlan)
 	return r.Run()
 }
 
+// newYouzanRequest 调用有赞接口的 LimitedRequest，共享配额并使用有赞 client 的 http.Client
+func (a *Api) newYouzanRequest() limitedRequest.Request {
+	return limitedRequest.New(&limitedRequest.Options{
+		Limiter:     a.limiter,
+		MaxInFlight: a.maxInFlight,
+		Prepare:     a.injectToken,
+		Retryable:   a.retryableYouzanTask,
+		HTTPClient:  a.youzan.HTTPClient(),
+	})
+}
+
+// injectToken 在请求发出前写入当前的 access_token，获取失败时 task 不再发出请求
+func (a *Api) injectToken(t *limitedRequest.Task) {
+	token, err := a.youzan.Token()
+	if err != nil {
+		logrus.Errorf("获取 access_token 失败: %v", err)
+		t.Err = fmt.Errorf("获取 access_token 失败: %v", err)
+		return
+	}
+	t.Params["access_token"] = token
+}
+
+// retryableYouzanTask 有赞返回临时错误或 token 失效时重试 task，重试前 injectToken 会写入新的 token
+func (a *Api) retryableYouzanTask(t *limitedRequest.Task) bool {
+	ye := youzan.DecodeError(t.Body)
+	if ye == nil {
+		return false
+	}
+	if ye.Kind() == youzan.ErrorKindAuth {
+		return a.youzan.HandleTokenError(t.Params["access_token"], t.Body)
+	}
+	return ye.Temporary()
+}
+
 func RespErr(c *gin.Context, err error, msg ...string) {
 	results := map[string]interface{}{
 		"status": 1,
@@ -47,6 +165,16 @@ func RespErr(c *gin.Context, err error, msg ...string) {
 	c.JSON(200, results)
 }
 
+// RespErrData 出错时同时返回详细信息，例如上传文件的校验结果
+func RespErrData(c *gin.Context, err error, msg string, data interface{}) {
+	c.JSON(200, map[string]interface{}{
+		"status": 1,
+		"err":    err,
+		"msg":    msg,
+		"data":   data,
+	})
+}
+
 func Resp(c *gin.Context, results interface{}) {
 	c.JSON(200, map[string]interface{}{
 		"status": 0,
@@ -0,0 +1,266 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	limitedRequest "github.com/xuyuntech/inventory_sync_go/limited_request"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+	"golang.org/x/sync/errgroup"
+)
+
+// applyResult 单个 sku 的同步结果
+type applyResult struct {
+	OfflineID   int64         `json:"offline_id"`
+	OfflineName string        `json:"offline_name"`
+	ItemID      int64         `json:"item_id"`
+	ItemTitle   string        `json:"item_title"`
+	SkuID       int64         `json:"sku_id"`
+	Success     bool          `json:"success"`
+	Msg         string        `json:"msg,omitempty"`
+	Error       *youzan.Error `json:"error,omitempty"`
+}
+
+// applySummary 写回结束时的汇总
+type applySummary struct {
+	Total   int `json:"total"`
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+}
+
+const (
+	// EventApplyResult 单个 sku 的写回结果，data 为 applyResult
+	EventApplyResult = "apply_result"
+	// EventApplyDone websocket 上一次写回结束，data 为 applySummary
+	EventApplyDone = "apply_done"
+)
+
+type skuUpdateResponse struct {
+	Response struct {
+		IsSuccess bool `json:"is_success"`
+	} `json:"response"`
+}
+
+// skuKey 标识一个门店商品的 sku
+func skuKey(itemID, offlineID, skuID int64) string {
+	return fmt.Sprintf("%d-%d-%d", itemID, offlineID, skuID)
+}
+
+// ApplyInventorySync 把选中的 goodUpdated 写回有赞，逐个 sku 返回结果
+// 只使用请求里的商品、门店和 sku ID，目标值以分析结果为准，需要审批的 sku 审批后才能写回
+// dry_run=true 时只返回将要发出的请求，不写回有赞
+func (a *Api) ApplyInventorySync(c *gin.Context) {
+	job, err := a.jobs.Get(c.Param("id"))
+	if err != nil {
+		RespErr(c, err, "任务不存在")
+		return
+	}
+	// 整体检查在分析完成后才会执行，分析中、失败或取消的 job 不能写回
+	if job.CurrentStatus() != JobStatusParsed {
+		RespErr(c, ErrJobNotReady, "分析完成后才能写回")
+		return
+	}
+	goods := make([]*goodUpdated, 0)
+	if err := json.NewDecoder(c.Request.Body).Decode(&goods); err != nil {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	goods, blocked, rejected, unknown := job.ResolveApply(goods)
+	if len(blocked) > 0 || len(rejected) > 0 || len(unknown) > 0 {
+		RespErrData(c, nil, "部分 sku 需要审批、已被拒绝或者不在分析结果里", map[string]interface{}{
+			"blocked":  blocked,
+			"rejected": rejected,
+			"unknown":  unknown,
+		})
+		return
+	}
+	tasks := a.buildApplyTasks(goods)
+	if len(tasks) == 0 {
+		RespErr(c, nil, "没有需要同步的 sku")
+		return
+	}
+	if c.Query("dry_run") == "true" {
+		Resp(c, dryRunRequests(tasks))
+		return
+	}
+	if err := job.BeginApply(); err != nil {
+		RespErr(c, err, "正在写回，请等待上一次写回结束")
+		return
+	}
+	defer job.EndApply()
+	a.streamApply(c, job, tasks)
+}
+
+// streamApply 发出更新请求，以 Server-Sent Events 逐个 sku 返回结果
+func (a *Api) streamApply(c *gin.Context, job *Job, tasks []*limitedRequest.Task) {
+	setSSEHeaders(c)
+	writeSSEPing(c.Writer)
+
+	// 客户端断开连接时取消还没发出的更新
+	summary := a.applyTasks(c.Request.Context(), job, tasks, func(id int, result *applyResult) {
+		writeSSE(c.Writer, &analysisEvent{
+			ID:   id,
+			Type: EventApplyResult,
+			Data: result,
+		})
+	}, func() {
+		writeSSEPing(c.Writer)
+	})
+	if summary != nil {
+		writeSSE(c.Writer, &analysisEvent{Type: EventDone, Data: summary})
+	}
+}
+
+// buildApplyTasks 每个 sku 生成一个调用有赞更新接口的 task，重复的 sku 只更新一次，没有变化字段的 sku 跳过
+func (a *Api) buildApplyTasks(goods []*goodUpdated) []*limitedRequest.Task {
+	tasks := make([]*limitedRequest.Task, 0)
+	taskIDs := make(map[string]bool)
+	for _, gu := range goods {
+		for _, sku := range gu.Skus {
+			id := skuKey(gu.ItemID, gu.OfflineID, sku.ID)
+			if taskIDs[id] {
+				continue
+			}
+			taskIDs[id] = true
+			params := map[string]string{
+				"num_iid":    fmt.Sprintf("%d", gu.ItemID),
+				"offline_id": fmt.Sprintf("%d", gu.OfflineID),
+				"sku_id":     fmt.Sprintf("%d", sku.ID),
+			}
+			// 只发送需要同步的字段，不同步的字段保留有赞里的值
+			for _, field := range sku.Changed {
+				switch field {
+				case ChangePrice:
+					params["price"] = sku.ToPrice.String()
+				case ChangeQuantity:
+					params["quantity"] = sku.ToQuantity.String()
+				}
+			}
+			if len(params) == 3 {
+				continue
+			}
+			tasks = append(tasks, &limitedRequest.Task{
+				ID:     id,
+				URL:    a.youzan.URL("youzan.multistore.goods.sku", "3.0.0", "update"),
+				Method: "POST",
+				Temp: map[string]interface{}{
+					"good": gu,
+					"sku":  sku,
+				},
+				Params: params,
+			})
+		}
+	}
+	return tasks
+}
+
+// applyTasks 发出更新请求，每完成一个 sku 调用一次 onResult，空闲 30s 调用一次 onIdle
+// ctx 结束时取消还没发出的更新并返回 nil
+func (a *Api) applyTasks(parent context.Context, job *Job, tasks []*limitedRequest.Task, onResult func(id int, result *applyResult), onIdle func()) *applySummary {
+	logrus.Infof("===== Start to apply %d skus to youzan. ====", len(tasks))
+
+	lreq := a.newYouzanRequest()
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		g       errgroup.Group
+		summary *applySummary
+	)
+	g.Go(func() error {
+		lreq.Add(ctx, tasks)
+		return nil
+	})
+	g.Go(func() error {
+		err := lreq.Start(ctx)
+		logrus.Debugf("LimitedRequest ended with err: %v", err)
+		return nil
+	})
+	g.Go(func() error {
+		defer cancel()
+		results := lreq.Results()
+		s := &applySummary{Total: len(tasks)}
+		for s.Success+s.Failed < len(tasks) {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second * 30):
+				onIdle()
+			case task := <-results:
+				result := parseApplyResult(task)
+				if result.Success {
+					s.Success++
+				} else {
+					s.Failed++
+				}
+				job.AddApplyResult(result)
+				onResult(s.Success+s.Failed, result)
+			}
+		}
+		summary = s
+		return nil
+	})
+	g.Wait()
+	return summary
+}
+
+// dryRunRequest 将要发给有赞的更新请求，不包含 access_token
+type dryRunRequest struct {
+	ID     string            `json:"id"`
+	Method string            `json:"method"`
+	URL    string            `json:"url"`
+	Params map[string]string `json:"params"`
+}
+
+func dryRunRequests(tasks []*limitedRequest.Task) []*dryRunRequest {
+	requests := make([]*dryRunRequest, 0, len(tasks))
+	for _, t := range tasks {
+		params := make(map[string]string, len(t.Params))
+		for k, v := range t.Params {
+			if k != "access_token" {
+				params[k] = v
+			}
+		}
+		requests = append(requests, &dryRunRequest{
+			ID:     t.ID,
+			Method: t.Method,
+			URL:    t.URL,
+			Params: params,
+		})
+	}
+	return requests
+}
+
+func parseApplyResult(task *limitedRequest.Task) *applyResult {
+	gu := task.Temp["good"].(*goodUpdated)
+	sku := task.Temp["sku"].(*goodUpdatedSku)
+	result := &applyResult{
+		OfflineID:   gu.OfflineID,
+		OfflineName: gu.OfflineName,
+		ItemID:      gu.ItemID,
+		ItemTitle:   gu.ItemTitle,
+		SkuID:       sku.ID,
+	}
+	if task.Err != nil {
+		result.Msg = task.Err.Error()
+		return result
+	}
+	if ye := youzan.DecodeError(task.Body); ye != nil {
+		result.Msg = ye.Error()
+		result.Error = ye
+		return result
+	}
+	resp := &skuUpdateResponse{}
+	if err := json.Unmarshal(task.Body, resp); err != nil {
+		logrus.Errorf("解析 sku 更新结果出错(%v), b: (%s)", err, string(task.Body))
+		result.Msg = err.Error()
+		return result
+	}
+	result.Success = resp.Response.IsSuccess
+	return result
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrProfileNotFound = errors.New("Column profile not found")
+
+// ColumnProfile 一种供应商文件的表头格式，Columns 为列名到表头的映射
+type ColumnProfile struct {
+	Name    string              `json:"name"`
+	Columns map[string][]string `json:"columns"`
+}
+
+// ProfileStore 保存列映射 profile，修改后写入 dataDir 下的 json 文件
+type ProfileStore struct {
+	path     string
+	profiles map[string]*ColumnProfile
+	sync.RWMutex
+}
+
+func NewProfileStore(dataDir string) (*ProfileStore, error) {
+	s := &ProfileStore{
+		path:     filepath.Join(dataDir, "column_profiles.json"),
+		profiles: make(map[string]*ColumnProfile),
+	}
+	if err := readDataFile(s.path, &s.profiles); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ProfileStore) Get(name string) (*ColumnProfile, error) {
+	s.RLock()
+	defer s.RUnlock()
+	p, ok := s.profiles[name]
+	if !ok {
+		return nil, ErrProfileNotFound
+	}
+	return p, nil
+}
+
+func (s *ProfileStore) List() []*ColumnProfile {
+	s.RLock()
+	profiles := make([]*ColumnProfile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		profiles = append(profiles, p)
+	}
+	s.RUnlock()
+	sort.Slice(profiles, func(i, k int) bool {
+		return profiles[i].Name < profiles[k].Name
+	})
+	return profiles
+}
+
+// Save 先写入文件，写入成功后才替换内存里的 profile
+func (s *ProfileStore) Save(p *ColumnProfile) error {
+	s.Lock()
+	defer s.Unlock()
+	profiles := s.copyProfiles()
+	profiles[p.Name] = p
+	return s.flush(profiles)
+}
+
+func (s *ProfileStore) Delete(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.profiles[name]; !ok {
+		return ErrProfileNotFound
+	}
+	profiles := s.copyProfiles()
+	delete(profiles, name)
+	return s.flush(profiles)
+}
+
+// copyProfiles 调用方需要持有锁
+func (s *ProfileStore) copyProfiles() map[string]*ColumnProfile {
+	profiles := make(map[string]*ColumnProfile, len(s.profiles)+1)
+	for k, v := range s.profiles {
+		profiles[k] = v
+	}
+	return profiles
+}
+
+// flush 写入文件成功后替换 s.profiles，调用方需要持有锁
+func (s *ProfileStore) flush(profiles map[string]*ColumnProfile) error {
+	if err := writeDataFile(s.path, profiles); err != nil {
+		return err
+	}
+	s.profiles = profiles
+	return nil
+}
+
+func (a *Api) ListProfiles(c *gin.Context) {
+	Resp(c, a.profiles.List())
+}
+
+func (a *Api) GetProfile(c *gin.Context) {
+	p, err := a.profiles.Get(c.Param("name"))
+	if err != nil {
+		RespErr(c, err, "列映射不存在")
+		return
+	}
+	Resp(c, p)
+}
+
+// SaveProfile 新建或覆盖一个列映射
+func (a *Api) SaveProfile(c *gin.Context) {
+	p := &ColumnProfile{}
+	if err := json.NewDecoder(c.Request.Body).Decode(p); err != nil {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	p.Name = c.Param("name")
+	for column := range p.Columns {
+		if _, ok := DefaultColumnAliases[column]; !ok {
+			RespErr(c, nil, "未知的列: "+column)
+			return
+		}
+	}
+	if err := a.profiles.Save(p); err != nil {
+		RespErr(c, err, "保存列映射失败")
+		return
+	}
+	Resp(c, p)
+}
+
+func (a *Api) DeleteProfile(c *gin.Context) {
+	if err := a.profiles.Delete(c.Param("name")); err != nil {
+		RespErr(c, err, "删除列映射失败")
+		return
+	}
+	Resp(c, nil)
+}
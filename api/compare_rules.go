@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuyuntech/inventory_sync_go/money"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+// 一个 sku 发生变化的字段
+const (
+	ChangePrice    = "price"
+	ChangeQuantity = "quantity"
+)
+
+// CompareRule 判断库存文件和有赞 sku 的差异是否需要同步
+type CompareRule struct {
+	Name string `json:"name"`
+	// SyncQuantity、SyncPrice 是否同步库存和价格，不设置时同步
+	SyncQuantity *bool `json:"sync_quantity,omitempty"`
+	SyncPrice    *bool `json:"sync_price,omitempty"`
+	// MinQuantityDiff 库存相差小于这个数量时忽略
+	MinQuantityDiff money.Stock `json:"min_quantity_diff"`
+	// MinQuantityDiffPercent 库存相差小于有赞库存的这个百分比时忽略
+	MinQuantityDiffPercent float64 `json:"min_quantity_diff_percent"`
+	// IgnoreZeroPrice 库存文件里价格为 0 或者为空时不同步价格
+	IgnoreZeroPrice bool `json:"ignore_zero_price"`
+}
+
+// DefaultCompareRule 没有配置时价格和库存有任何差异都同步
+var DefaultCompareRule = &CompareRule{
+	Name: "default",
+}
+
+// CompareRules 默认规则和按门店覆盖的规则，Stores 的 key 为门店 ID 或门店名称
+type CompareRules struct {
+	Default *CompareRule            `json:"default"`
+	Stores  map[string]*CompareRule `json:"stores"`
+}
+
+// For 返回门店使用的规则，先按门店 ID 再按门店名称查找
+func (rs *CompareRules) For(offlineID, offlineName string) *CompareRule {
+	if r, ok := rs.Stores[offlineID]; ok {
+		return r
+	}
+	if r, ok := rs.Stores[offlineName]; ok {
+		return r
+	}
+	if rs.Default != nil {
+		return rs.Default
+	}
+	return DefaultCompareRule
+}
+
+// skuChange 按规则计算出的 sku 目标值，不同步的字段保持有赞的当前值
+type skuChange struct {
+	ToPrice    money.Money
+	ToQuantity money.Stock
+	Changed    []string
+}
+
+// Compare 返回需要同步的变化，没有需要同步的字段时返回 nil
+func (r *CompareRule) Compare(row *ExcelRow, sku *youzan.GoodsSku) *skuChange {
+	change := &skuChange{
+		ToPrice:    sku.Price,
+		ToQuantity: sku.Quantity,
+		Changed:    make([]string, 0, 2),
+	}
+	if r.syncPrice() && !row.NoPrice && !(r.IgnoreZeroPrice && row.Price == 0) && row.Price != sku.Price {
+		change.ToPrice = row.Price
+		change.Changed = append(change.Changed, ChangePrice)
+	}
+	if r.syncQuantity() && row.Quantity != sku.Quantity && !r.ignoreQuantity(row.Quantity, sku.Quantity) {
+		change.ToQuantity = row.Quantity
+		change.Changed = append(change.Changed, ChangeQuantity)
+	}
+	if len(change.Changed) == 0 {
+		return nil
+	}
+	return change
+}
+
+func (r *CompareRule) syncPrice() bool {
+	return r.SyncPrice == nil || *r.SyncPrice
+}
+
+func (r *CompareRule) syncQuantity() bool {
+	return r.SyncQuantity == nil || *r.SyncQuantity
+}
+
+// validate 返回规则配置的错误，没有错误时返回空字符串
+func (r *CompareRule) validate() string {
+	if r.MinQuantityDiff < 0 {
+		return "规则[" + r.Name + "]的 min_quantity_diff 不能小于 0"
+	}
+	if r.MinQuantityDiffPercent < 0 || r.MinQuantityDiffPercent > 100 {
+		return "规则[" + r.Name + "]的 min_quantity_diff_percent 必须在 0 到 100 之间"
+	}
+	return ""
+}
+
+func (r *CompareRule) ignoreQuantity(to, from money.Stock) bool {
+	diff := to - from
+	if diff < 0 {
+		diff = -diff
+	}
+	if r.MinQuantityDiff > 0 && diff < r.MinQuantityDiff {
+		return true
+	}
+	if r.MinQuantityDiffPercent > 0 && from > 0 && float64(diff)/float64(from)*100 < r.MinQuantityDiffPercent {
+		return true
+	}
+	return false
+}
+
+// CompareRuleStore 保存对比规则，修改后写入 dataDir 下的 json 文件
+type CompareRuleStore struct {
+	path  string
+	rules *CompareRules
+	sync.RWMutex
+}
+
+func NewCompareRuleStore(dataDir string) (*CompareRuleStore, error) {
+	s := &CompareRuleStore{
+		path: filepath.Join(dataDir, "compare_rules.json"),
+		rules: &CompareRules{
+			Default: DefaultCompareRule,
+			Stores:  make(map[string]*CompareRule),
+		},
+	}
+	if err := readDataFile(s.path, s.rules); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get 返回当前规则，保存新规则时整体替换，分析过程中使用的规则不会被修改
+func (s *CompareRuleStore) Get() *CompareRules {
+	s.RLock()
+	defer s.RUnlock()
+	return s.rules
+}
+
+func (s *CompareRuleStore) Save(rules *CompareRules) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := writeDataFile(s.path, rules); err != nil {
+		return err
+	}
+	s.rules = rules
+	return nil
+}
+
+func (a *Api) GetCompareRules(c *gin.Context) {
+	Resp(c, a.compareRules.Get())
+}
+
+// SaveCompareRules 替换全部对比规则
+func (a *Api) SaveCompareRules(c *gin.Context) {
+	rules := &CompareRules{}
+	if err := json.NewDecoder(c.Request.Body).Decode(rules); err != nil {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	if rules.Stores == nil {
+		rules.Stores = make(map[string]*CompareRule)
+	}
+	if rules.Default != nil {
+		if rules.Default.Name == "" {
+			rules.Default.Name = "default"
+		}
+		if msg := rules.Default.validate(); msg != "" {
+			RespErr(c, nil, msg)
+			return
+		}
+	}
+	for store, r := range rules.Stores {
+		if r == nil {
+			RespErr(c, nil, "门店["+store+"]的规则为空")
+			return
+		}
+		if r.Name == "" {
+			r.Name = store
+		}
+		if msg := r.validate(); msg != "" {
+			RespErr(c, nil, msg)
+			return
+		}
+	}
+	if err := a.compareRules.Save(rules); err != nil {
+		RespErr(c, err, "保存对比规则失败")
+		return
+	}
+	Resp(c, rules)
+}
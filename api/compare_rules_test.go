@@ -0,0 +1,136 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestCompareRule(t *testing.T) {
+	sku := &youzan.GoodsSku{Price: 1000, Quantity: 100}
+	cases := []struct {
+		name string
+		rule *CompareRule
+		row  *ExcelRow
+		want *skuChange
+	}{
+		{
+			name: "no change",
+			rule: DefaultCompareRule,
+			row:  &ExcelRow{Price: 1000, Quantity: 100},
+		},
+		{
+			name: "price and quantity",
+			rule: DefaultCompareRule,
+			row:  &ExcelRow{Price: 1200, Quantity: 90},
+			want: &skuChange{ToPrice: 1200, ToQuantity: 90, Changed: []string{ChangePrice, ChangeQuantity}},
+		},
+		{
+			name: "no price column",
+			rule: DefaultCompareRule,
+			row:  &ExcelRow{NoPrice: true, Quantity: 90},
+			want: &skuChange{ToPrice: 1000, ToQuantity: 90, Changed: []string{ChangeQuantity}},
+		},
+		{
+			name: "sync price off",
+			rule: &CompareRule{SyncPrice: boolPtr(false)},
+			row:  &ExcelRow{Price: 1200, Quantity: 100},
+		},
+		{
+			name: "sync quantity off",
+			rule: &CompareRule{SyncQuantity: boolPtr(false)},
+			row:  &ExcelRow{Price: 1200, Quantity: 0},
+			want: &skuChange{ToPrice: 1200, ToQuantity: 100, Changed: []string{ChangePrice}},
+		},
+		{
+			name: "ignore zero price",
+			rule: &CompareRule{IgnoreZeroPrice: true},
+			row:  &ExcelRow{Price: 0, Quantity: 100},
+		},
+		{
+			name: "zero price is synced by default",
+			rule: DefaultCompareRule,
+			row:  &ExcelRow{Price: 0, Quantity: 100},
+			want: &skuChange{ToPrice: 0, ToQuantity: 100, Changed: []string{ChangePrice}},
+		},
+		{
+			name: "below min diff",
+			rule: &CompareRule{MinQuantityDiff: 5},
+			row:  &ExcelRow{Price: 1000, Quantity: 96},
+		},
+		{
+			name: "at min diff",
+			rule: &CompareRule{MinQuantityDiff: 5},
+			row:  &ExcelRow{Price: 1000, Quantity: 105},
+			want: &skuChange{ToPrice: 1000, ToQuantity: 105, Changed: []string{ChangeQuantity}},
+		},
+		{
+			name: "below min percent",
+			rule: &CompareRule{MinQuantityDiffPercent: 10},
+			row:  &ExcelRow{Price: 1000, Quantity: 91},
+		},
+		{
+			name: "at min percent",
+			rule: &CompareRule{MinQuantityDiffPercent: 10},
+			row:  &ExcelRow{Price: 1000, Quantity: 110},
+			want: &skuChange{ToPrice: 1000, ToQuantity: 110, Changed: []string{ChangeQuantity}},
+		},
+	}
+	for _, c := range cases {
+		got := c.rule.Compare(c.row, sku)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: Compare = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	// 有赞库存为 0 时百分比没有意义，任何差异都同步
+	rule := &CompareRule{MinQuantityDiffPercent: 50}
+	if got := rule.Compare(&ExcelRow{Price: 1000, Quantity: 1}, &youzan.GoodsSku{Price: 1000}); got == nil {
+		t.Error("Compare from zero quantity = nil, want a change")
+	}
+}
+
+func TestCompareRulesFor(t *testing.T) {
+	byID := &CompareRule{Name: "by id"}
+	byName := &CompareRule{Name: "by name"}
+	def := &CompareRule{Name: "custom default"}
+	cases := []struct {
+		rules *CompareRules
+		id    string
+		name  string
+		want  *CompareRule
+	}{
+		{rules: &CompareRules{Default: def, Stores: map[string]*CompareRule{"101": byID, "徐汇店": byName}}, id: "101", name: "徐汇店", want: byID},
+		{rules: &CompareRules{Default: def, Stores: map[string]*CompareRule{"徐汇店": byName}}, id: "101", name: "徐汇店", want: byName},
+		{rules: &CompareRules{Default: def, Stores: map[string]*CompareRule{"徐汇店": byName}}, id: "102", name: "静安店", want: def},
+		{rules: &CompareRules{}, id: "102", name: "静安店", want: DefaultCompareRule},
+	}
+	for _, c := range cases {
+		if got := c.rules.For(c.id, c.name); got != c.want {
+			t.Errorf("For(%q, %q) = %s, want %s", c.id, c.name, got.Name, c.want.Name)
+		}
+	}
+}
+
+func TestCompareRuleValidate(t *testing.T) {
+	cases := []struct {
+		rule *CompareRule
+		ok   bool
+	}{
+		{rule: &CompareRule{}, ok: true},
+		{rule: &CompareRule{MinQuantityDiff: 3, MinQuantityDiffPercent: 100}, ok: true},
+		{rule: &CompareRule{MinQuantityDiff: -1}},
+		{rule: &CompareRule{MinQuantityDiffPercent: -1}},
+		{rule: &CompareRule{MinQuantityDiffPercent: 101}},
+	}
+	for _, c := range cases {
+		if msg := c.rule.validate(); (msg == "") != c.ok {
+			t.Errorf("validate(%+v) = %q, want ok %v", c.rule, msg, c.ok)
+		}
+	}
+}
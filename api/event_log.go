@@ -0,0 +1,60 @@
+package api
+
+import "sync"
+
+// eventLog 保存一次分析输出的所有事件，断线重连的客户端可以从任意事件之后继续接收
+type eventLog struct {
+	events []*analysisEvent
+	closed bool
+	// changed 在有新事件或者关闭时被 close，然后换成新的 channel
+	changed chan struct{}
+	sync.Mutex
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{
+		events:  make([]*analysisEvent, 0),
+		changed: make(chan struct{}),
+	}
+}
+
+// Append 追加事件，事件 ID 从 1 开始递增
+func (l *eventLog) Append(eventType string, data interface{}) *analysisEvent {
+	l.Lock()
+	defer l.Unlock()
+	e := &analysisEvent{
+		ID:   len(l.events) + 1,
+		Type: eventType,
+		Data: data,
+	}
+	if l.closed {
+		return e
+	}
+	l.events = append(l.events, e)
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return e
+}
+
+func (l *eventLog) Close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.changed)
+}
+
+// Since 返回 ID 大于 id 的事件，以及在下一次变化时被 close 的 channel；closed 为 true 时不会再有新事件
+func (l *eventLog) Since(id int) (events []*analysisEvent, changed <-chan struct{}, closed bool) {
+	l.Lock()
+	defer l.Unlock()
+	if id < 0 {
+		id = 0
+	}
+	if id < len(l.events) {
+		events = l.events[id:]
+	}
+	return events, l.changed, l.closed
+}
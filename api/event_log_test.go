@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEventLogSince(t *testing.T) {
+	l := newEventLog()
+	for _, typ := range []string{EventDiff, EventProgress, EventDone} {
+		l.Append(typ, nil)
+	}
+	cases := []struct {
+		id   int
+		want []int
+	}{
+		{id: 0, want: []int{1, 2, 3}},
+		{id: -1, want: []int{1, 2, 3}},
+		{id: 1, want: []int{2, 3}},
+		{id: 3, want: nil},
+		{id: 10, want: nil},
+	}
+	for _, c := range cases {
+		events, _, closed := l.Since(c.id)
+		if closed {
+			t.Errorf("Since(%d) closed before Close", c.id)
+		}
+		if len(events) != len(c.want) {
+			t.Errorf("Since(%d) = %d events, want %v", c.id, len(events), c.want)
+			continue
+		}
+		for i, e := range events {
+			if e.ID != c.want[i] {
+				t.Errorf("Since(%d)[%d].ID = %d, want %d", c.id, i, e.ID, c.want[i])
+			}
+		}
+	}
+}
+
+func TestEventLogResume(t *testing.T) {
+	l := newEventLog()
+	l.Append(EventDiff, nil)
+	events, changed, _ := l.Since(0)
+	if len(events) != 1 {
+		t.Fatalf("Since(0) = %d events, want 1", len(events))
+	}
+	select {
+	case <-changed:
+		t.Fatal("changed closed without new events")
+	default:
+	}
+
+	l.Append(EventProgress, nil)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changed not closed after Append")
+	}
+	events, changed, closed := l.Since(events[len(events)-1].ID)
+	if len(events) != 1 || events[0].Type != EventProgress || closed {
+		t.Fatalf("resume = %d events, closed %v, want 1 %s event", len(events), closed, EventProgress)
+	}
+
+	l.Close()
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changed not closed after Close")
+	}
+	if e := l.Append(EventDone, nil); e.ID != 3 {
+		t.Errorf("Append after Close ID = %d, want 3", e.ID)
+	}
+	events, _, closed = l.Since(2)
+	if len(events) != 0 || !closed {
+		t.Errorf("Since(2) after Close = %d events, closed %v, want 0, true", len(events), closed)
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		header string
+		query  string
+		want   int
+	}{
+		{want: 0},
+		{header: "5", want: 5},
+		{query: "last_event_id=7", want: 7},
+		{header: "5", query: "last_event_id=7", want: 5},
+		{header: "abc", want: 0},
+	}
+	for _, c := range cases {
+		c0, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c0.Request, _ = http.NewRequest("GET", "/?"+c.query, nil)
+		if c.header != "" {
+			c0.Request.Header.Set("Last-Event-ID", c.header)
+		}
+		if got := lastEventID(c0); got != c.want {
+			t.Errorf("lastEventID(header %q, query %q) = %d, want %d", c.header, c.query, got, c.want)
+		}
+	}
+}
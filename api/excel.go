@@ -1,9 +1,236 @@
 package api
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xuyuntech/inventory_sync_go/money"
+)
+
+// ExcelRow 库存文件里的一行，SkuNO 为空时这一行对商品的所有 sku 生效
+// ItemNO 为空时按 SkuNO 到有赞查找商品
 type ExcelRow struct {
-	ItemNO    string  `json:"item_no" xlsx:"0"`
-	OfflineID string  `json:"offline_id" xlsx:"1"`
-	ShopName  string  `json:"shop_name" xlsx:"2"`
-	Quantity  float64 `json:"quantity" xlsx:"3"`
-	Price     float64 `json:"price" xlsx:"4"`
+	ItemNO    string      `json:"item_no"`
+	SkuNO     string      `json:"sku_no,omitempty"`
+	OfflineID string      `json:"offline_id"`
+	ShopName  string      `json:"shop_name"`
+	Quantity  money.Stock `json:"quantity"`
+	Price     money.Money `json:"price"`
+	// NoPrice 库存文件里没有价格列或者价格为空，只同步库存
+	NoPrice bool `json:"no_price,omitempty"`
+	// Cost 成本价，为 0 时不检查发布价格是否低于成本
+	Cost money.Money `json:"cost,omitempty"`
+	// Properties 规格列的值，例如 {"颜色": "红", "尺码": "XL"}，按规格组合匹配 sku
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// propertyKey 规格组合的字符串形式，用于判断重复的行
+func (r *ExcelRow) propertyKey() string {
+	keys := make([]string, 0, len(r.Properties))
+	for k := range r.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+":"+r.Properties[k])
+	}
+	return strings.Join(parts, ";")
+}
+
+// 库存文件里的列，值为 ColumnProfile.Columns 的 key
+const (
+	ColumnItemNO    = "item_no"
+	ColumnSkuNO     = "sku_no"
+	ColumnOfflineID = "offline_id"
+	ColumnShopName  = "shop_name"
+	ColumnQuantity  = "quantity"
+	ColumnPrice     = "price"
+	ColumnCost      = "cost"
+)
+
+// DefaultColumnAliases 没有选择 profile 时按这些表头识别列，不区分大小写
+var DefaultColumnAliases = map[string][]string{
+	ColumnItemNO:    {"商品编码", "商家编码", "商品编号", "编码", "item_no", "item no"},
+	ColumnSkuNO:     {"sku编码", "规格编码", "sku商家编码", "sku_no", "sku no", "sku"},
+	ColumnOfflineID: {"门店ID", "门店编号", "门店id", "offline_id", "store_id"},
+	ColumnShopName:  {"门店", "门店名称", "店铺", "shop_name", "shop", "store"},
+	ColumnQuantity:  {"库存", "库存数量", "数量", "quantity", "stock", "qty"},
+	ColumnPrice:     {"价格", "售价", "单价", "price"},
+	ColumnCost:      {"成本", "成本价", "进价", "cost"},
+}
+
+// PropertyColumnPrefixes 表头以这些前缀开头的列是规格列，前缀后面是规格名称，例如 "规格:颜色"
+var PropertyColumnPrefixes = []string{"规格:", "规格：", "spec:"}
+
+// requiredColumns 缺少时拒绝上传，商品编码和 sku 编码、门店 ID 和门店名称都至少要有一个，没有价格列时只同步库存
+var requiredColumns = []string{ColumnQuantity}
+
+// columnMapping 列名到表格中列下标的映射
+type columnMapping struct {
+	index map[string]int
+	// properties 规格名称到列下标的映射
+	properties map[string]int
+	// defaults 表格里没有这一列或者单元格为空时使用的值，例如按 sheet 区分门店时的门店
+	defaults map[string]string
+}
+
+func normalizeHeader(h string) string {
+	return strings.ToLower(strings.TrimSpace(h))
+}
+
+// newColumnMapping 根据表头找到每一列的位置，profile 里的表头优先于默认的别名
+func newColumnMapping(header []string, profile *ColumnProfile, defaults map[string]string) (*columnMapping, error) {
+	index := make(map[string]int)
+	properties := make(map[string]int)
+	for i, h := range header {
+		if name := propertyColumnName(h); name != "" {
+			properties[name] = i
+			continue
+		}
+		h = normalizeHeader(h)
+		if _, ok := index[h]; h != "" && !ok {
+			index[h] = i
+		}
+	}
+	mapping := &columnMapping{
+		index:      make(map[string]int),
+		properties: properties,
+		defaults:   defaults,
+	}
+	for column, aliases := range DefaultColumnAliases {
+		if profile != nil {
+			aliases = append(append([]string{}, profile.Columns[column]...), aliases...)
+		}
+		for _, alias := range aliases {
+			if i, ok := index[normalizeHeader(alias)]; ok {
+				mapping.index[column] = i
+				break
+			}
+		}
+	}
+	missing := make([]string, 0)
+	for _, column := range requiredColumns {
+		if !mapping.has(column) {
+			missing = append(missing, column)
+		}
+	}
+	if !mapping.has(ColumnItemNO) && !mapping.has(ColumnSkuNO) {
+		missing = append(missing, ColumnItemNO+"/"+ColumnSkuNO)
+	}
+	if !mapping.has(ColumnOfflineID) && !mapping.has(ColumnShopName) {
+		missing = append(missing, ColumnShopName)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("表头中找不到列: %s", strings.Join(missing, ", "))
+	}
+	return mapping, nil
+}
+
+// propertyColumnName 规格列的规格名称，不是规格列时返回空字符串
+func propertyColumnName(h string) string {
+	h = strings.TrimSpace(h)
+	for _, prefix := range PropertyColumnPrefixes {
+		if len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+			return strings.TrimSpace(h[len(prefix):])
+		}
+	}
+	return ""
+}
+
+func (m *columnMapping) has(column string) bool {
+	_, ok := m.index[column]
+	return ok || m.defaults[column] != ""
+}
+
+func (m *columnMapping) value(cells []string, column string) string {
+	if i, ok := m.index[column]; ok && i < len(cells) {
+		if v := strings.TrimSpace(cells[i]); v != "" {
+			return v
+		}
+	}
+	return m.defaults[column]
+}
+
+func (m *columnMapping) price(cells []string) (money.Money, *rowError) {
+	v := m.value(cells, ColumnPrice)
+	if v == "" {
+		return 0, &rowError{Column: ColumnPrice, Reason: "为空"}
+	}
+	price, err := money.ParseMoney(v)
+	if err != nil {
+		return 0, &rowError{Column: ColumnPrice, Value: v, Reason: err.Error()}
+	}
+	if price < 0 {
+		return price, &rowError{Column: ColumnPrice, Value: v, Reason: "不能为负数"}
+	}
+	return price, nil
+}
+
+func (m *columnMapping) quantity(cells []string) (money.Stock, *rowError) {
+	v := m.value(cells, ColumnQuantity)
+	if v == "" {
+		return 0, &rowError{Column: ColumnQuantity, Reason: "为空"}
+	}
+	quantity, err := money.ParseStock(v)
+	if err != nil {
+		return 0, &rowError{Column: ColumnQuantity, Value: v, Reason: err.Error()}
+	}
+	if quantity < 0 {
+		return quantity, &rowError{Column: ColumnQuantity, Value: v, Reason: "不能为负数"}
+	}
+	return quantity, nil
+}
+
+// ParseRow 把一行单元格转换为 ExcelRow，返回每个有问题的列，sheet 和行号由调用方填写
+func (m *columnMapping) ParseRow(cells []string) (*ExcelRow, []*rowError) {
+	row := &ExcelRow{
+		ItemNO:    m.value(cells, ColumnItemNO),
+		SkuNO:     m.value(cells, ColumnSkuNO),
+		OfflineID: m.value(cells, ColumnOfflineID),
+		ShopName:  m.value(cells, ColumnShopName),
+	}
+	for name, i := range m.properties {
+		if i < len(cells) && strings.TrimSpace(cells[i]) != "" {
+			if row.Properties == nil {
+				row.Properties = make(map[string]string)
+			}
+			row.Properties[name] = strings.TrimSpace(cells[i])
+		}
+	}
+	errs := make([]*rowError, 0)
+	if row.ItemNO == "" && row.SkuNO == "" {
+		errs = append(errs, &rowError{Column: ColumnItemNO, Reason: "商品编码和 sku 编码都为空"})
+	}
+	if row.OfflineID == "" && row.ShopName == "" {
+		errs = append(errs, &rowError{Column: ColumnShopName, Reason: "为空"})
+	}
+	var err *rowError
+	if row.Quantity, err = m.quantity(cells); err != nil {
+		errs = append(errs, err)
+	}
+	if v := m.value(cells, ColumnCost); v != "" {
+		cost, err := money.ParseMoney(v)
+		if err != nil || cost < 0 {
+			errs = append(errs, &rowError{Column: ColumnCost, Value: v, Reason: "不是正确的金额"})
+		}
+		row.Cost = cost
+	}
+	if m.value(cells, ColumnPrice) == "" {
+		row.NoPrice = true
+	} else if row.Price, err = m.price(cells); err != nil {
+		errs = append(errs, err)
+	}
+	return row, errs
+}
+
+// isBlank 整行都是空单元格
+func isBlank(cells []string) bool {
+	for _, cell := range cells {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewColumnMapping(t *testing.T) {
+	cases := []struct {
+		header   []string
+		profile  *ColumnProfile
+		defaults map[string]string
+		want     map[string]int
+		props    map[string]int
+		err      string
+	}{
+		{
+			header: []string{"商品编码", " 门店 ", "库存", "价格"},
+			want:   map[string]int{ColumnItemNO: 0, ColumnShopName: 1, ColumnQuantity: 2, ColumnPrice: 3},
+		},
+		{
+			header: []string{"SKU", "Store_ID", "QTY", "规格:颜色", "spec: 尺码"},
+			want:   map[string]int{ColumnSkuNO: 0, ColumnOfflineID: 1, ColumnQuantity: 2},
+			props:  map[string]int{"颜色": 3, "尺码": 4},
+		},
+		{
+			header:  []string{"货号", "库存", "库存数量", "门店"},
+			profile: &ColumnProfile{Name: "a", Columns: map[string][]string{ColumnItemNO: {"货号"}, ColumnQuantity: {"库存数量"}}},
+			want:    map[string]int{ColumnItemNO: 0, ColumnQuantity: 2, ColumnShopName: 3},
+		},
+		{
+			header:   []string{"商品编码", "库存"},
+			defaults: map[string]string{ColumnShopName: "徐汇店"},
+			want:     map[string]int{ColumnItemNO: 0, ColumnQuantity: 1},
+		},
+		{
+			header: []string{"商品编码", "门店"},
+			err:    ColumnQuantity,
+		},
+		{
+			header: []string{"库存", "门店"},
+			err:    ColumnItemNO + "/" + ColumnSkuNO,
+		},
+		{
+			header: []string{"商品编码", "库存"},
+			err:    ColumnShopName,
+		},
+	}
+	for _, c := range cases {
+		m, err := newColumnMapping(c.header, c.profile, c.defaults)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("newColumnMapping(%q) error = %v, want missing %s", c.header, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newColumnMapping(%q) error: %v", c.header, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.index, c.want) {
+			t.Errorf("newColumnMapping(%q) index = %v, want %v", c.header, m.index, c.want)
+		}
+		props := c.props
+		if props == nil {
+			props = map[string]int{}
+		}
+		if !reflect.DeepEqual(m.properties, props) {
+			t.Errorf("newColumnMapping(%q) properties = %v, want %v", c.header, m.properties, props)
+		}
+	}
+}
+
+func TestParseRow(t *testing.T) {
+	header := []string{"商品编码", "sku编码", "门店ID", "门店", "库存", "价格", "成本", "规格:颜色"}
+	m, err := newColumnMapping(header, nil, map[string]string{ColumnShopName: "默认店"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		cells  []string
+		want   *ExcelRow
+		errCol []string
+	}{
+		{
+			cells: []string{" A1 ", "", "", "徐汇店", "10", "12.30", "", ""},
+			want:  &ExcelRow{ItemNO: "A1", ShopName: "徐汇店", Quantity: 10, Price: 1230},
+		},
+		{
+			cells: []string{"", "S1", "101", "", "1,000", "", "5", "红"},
+			want: &ExcelRow{SkuNO: "S1", OfflineID: "101", ShopName: "默认店", Quantity: 1000, NoPrice: true, Cost: 500,
+				Properties: map[string]string{"颜色": "红"}},
+		},
+		{
+			cells: []string{"A1", "", "", "", "3"},
+			want:  &ExcelRow{ItemNO: "A1", ShopName: "默认店", Quantity: 3, NoPrice: true},
+		},
+		{
+			cells:  []string{"", "", "", "徐汇店", "10", "1"},
+			errCol: []string{ColumnItemNO},
+		},
+		{
+			cells:  []string{"A1", "", "", "徐汇店", "", "1"},
+			errCol: []string{ColumnQuantity},
+		},
+		{
+			cells:  []string{"A1", "", "", "徐汇店", "1.5", "-1", "abc"},
+			errCol: []string{ColumnQuantity, ColumnCost, ColumnPrice},
+		},
+	}
+	for _, c := range cases {
+		row, errs := m.ParseRow(c.cells)
+		cols := make([]string, 0)
+		for _, e := range errs {
+			cols = append(cols, e.Column)
+		}
+		if c.errCol != nil {
+			if !reflect.DeepEqual(cols, c.errCol) {
+				t.Errorf("ParseRow(%q) errors = %v, want %v", c.cells, cols, c.errCol)
+			}
+			continue
+		}
+		if len(errs) > 0 {
+			t.Errorf("ParseRow(%q) errors: %v", c.cells, errs)
+			continue
+		}
+		if !reflect.DeepEqual(row, c.want) {
+			t.Errorf("ParseRow(%q) = %+v, want %+v", c.cells, row, c.want)
+		}
+	}
+}
+
+func TestPropertyKey(t *testing.T) {
+	a := &ExcelRow{Properties: map[string]string{"颜色": "红", "尺码": "XL"}}
+	b := &ExcelRow{Properties: map[string]string{"尺码": "XL", "颜色": "红"}}
+	if a.propertyKey() != b.propertyKey() {
+		t.Errorf("propertyKey %q != %q", a.propertyKey(), b.propertyKey())
+	}
+	if k := (&ExcelRow{}).propertyKey(); k != "" {
+		t.Errorf("empty propertyKey = %q", k)
+	}
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/xuyuntech/inventory_sync_go/money"
+)
+
+// 需要审批的原因
+const (
+	GuardrailPriceChange = "price_change"
+	GuardrailBelowCost   = "below_cost"
+	GuardrailZeroed      = "zeroed"
+	GuardrailStockDrop   = "stock_drop"
+)
+
+// EventGuardrail 分析结束时发现的需要审批的变更，data 为 guardrailViolation
+const EventGuardrail = "guardrail"
+
+// GuardrailPolicy 写回有赞之前的检查，触发的 sku 需要审批后才能写回，各项为 0 时不检查
+type GuardrailPolicy struct {
+	// MaxPriceChangePercent 价格变化超过原价的这个百分比
+	MaxPriceChangePercent float64 `json:"max_price_change_percent"`
+	// MaxZeroedSkus 库存变为 0 的 sku 超过这个数量时，所有变为 0 的 sku 都需要审批
+	MaxZeroedSkus int `json:"max_zeroed_skus"`
+	// MaxStoreStockDropPercent 一个门店需要更新的 sku 的库存合计下降超过这个百分比时，这个门店所有库存下降的 sku 都需要审批
+	MaxStoreStockDropPercent float64 `json:"max_store_stock_drop_percent"`
+	// CheckCost 发布价格低于库存文件里的成本价
+	CheckCost bool `json:"check_cost"`
+}
+
+// guardrailViolation 一次违反检查，Keys 为需要审批的 sku
+type guardrailViolation struct {
+	Rule string   `json:"rule"`
+	Msg  string   `json:"msg"`
+	Keys []string `json:"keys"`
+}
+
+// checkSku 单个 sku 的检查，在生成 diff 时调用
+func (p *GuardrailPolicy) checkSku(sku *goodUpdatedSku, cost money.Money) []string {
+	violations := make([]string, 0)
+	if p.MaxPriceChangePercent > 0 && sku.ToPrice != sku.Price {
+		if sku.Price == 0 || math.Abs(float64(sku.ToPrice-sku.Price))/float64(sku.Price)*100 > p.MaxPriceChangePercent {
+			violations = append(violations, GuardrailPriceChange)
+		}
+	}
+	if p.CheckCost && cost > 0 && sku.ToPrice < cost {
+		violations = append(violations, GuardrailBelowCost)
+	}
+	return violations
+}
+
+// checkResults 对所有 diff 的整体检查，在分析结束时调用
+func (p *GuardrailPolicy) checkResults(results []*goodUpdated) []*guardrailViolation {
+	violations := make([]*guardrailViolation, 0)
+	if p.MaxZeroedSkus > 0 {
+		zeroed := make([]string, 0)
+		for _, gu := range results {
+			for _, sku := range gu.Skus {
+				if sku.ToQuantity == 0 && sku.Quantity > 0 {
+					zeroed = append(zeroed, skuKey(gu.ItemID, gu.OfflineID, sku.ID))
+				}
+			}
+		}
+		if len(zeroed) > p.MaxZeroedSkus {
+			violations = append(violations, &guardrailViolation{
+				Rule: GuardrailZeroed,
+				Msg:  fmt.Sprintf("%d 个 sku 的库存会变为 0，超过了 %d 个", len(zeroed), p.MaxZeroedSkus),
+				Keys: zeroed,
+			})
+		}
+	}
+	if p.MaxStoreStockDropPercent > 0 {
+		type storeStock struct {
+			name      string
+			from, to  int64
+			decreased []string
+		}
+		stores := make(map[int64]*storeStock)
+		ids := make([]int64, 0)
+		for _, gu := range results {
+			s, ok := stores[gu.OfflineID]
+			if !ok {
+				s = &storeStock{name: gu.OfflineName}
+				stores[gu.OfflineID] = s
+				ids = append(ids, gu.OfflineID)
+			}
+			for _, sku := range gu.Skus {
+				s.from += int64(sku.Quantity)
+				s.to += int64(sku.ToQuantity)
+				if sku.ToQuantity < sku.Quantity {
+					s.decreased = append(s.decreased, skuKey(gu.ItemID, gu.OfflineID, sku.ID))
+				}
+			}
+		}
+		sort.Slice(ids, func(i, k int) bool { return ids[i] < ids[k] })
+		for _, id := range ids {
+			s := stores[id]
+			if s.from <= 0 || s.to >= s.from {
+				continue
+			}
+			drop := float64(s.from-s.to) / float64(s.from) * 100
+			if drop > p.MaxStoreStockDropPercent {
+				violations = append(violations, &guardrailViolation{
+					Rule: GuardrailStockDrop,
+					Msg:  fmt.Sprintf("门店[%s]的库存合计从 %d 下降到 %d，下降了 %.1f%%", s.name, s.from, s.to, drop),
+					Keys: s.decreased,
+				})
+			}
+		}
+	}
+	return violations
+}
+
+// GuardrailStore 保存检查规则，修改后写入 dataDir 下的 json 文件
+type GuardrailStore struct {
+	path   string
+	policy *GuardrailPolicy
+	sync.RWMutex
+}
+
+func NewGuardrailStore(dataDir string) (*GuardrailStore, error) {
+	s := &GuardrailStore{
+		path:   filepath.Join(dataDir, "guardrails.json"),
+		policy: &GuardrailPolicy{},
+	}
+	if err := readDataFile(s.path, s.policy); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *GuardrailStore) Get() *GuardrailPolicy {
+	s.RLock()
+	defer s.RUnlock()
+	return s.policy
+}
+
+func (s *GuardrailStore) Save(policy *GuardrailPolicy) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := writeDataFile(s.path, policy); err != nil {
+		return err
+	}
+	s.policy = policy
+	return nil
+}
+
+func (a *Api) GetGuardrails(c *gin.Context) {
+	Resp(c, a.guardrails.Get())
+}
+
+// SaveGuardrails 修改检查规则，需要审批权限
+func (a *Api) SaveGuardrails(c *gin.Context) {
+	if _, ok := a.approver(c); !ok {
+		RespErr(c, nil, "没有审批权限")
+		return
+	}
+	policy := &GuardrailPolicy{}
+	if err := json.NewDecoder(c.Request.Body).Decode(policy); err != nil {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	if err := a.guardrails.Save(policy); err != nil {
+		RespErr(c, err, "保存检查规则失败")
+		return
+	}
+	Resp(c, policy)
+}
+
+// approver 按 X-Access-Token 返回审批人
+func (a *Api) approver(c *gin.Context) (string, bool) {
+	token := c.GetHeader("X-Access-Token")
+	if token == "" {
+		return "", false
+	}
+	name, ok := a.approvers[token]
+	return name, ok
+}
+
+// approval 一个 sku 的审批记录
+type approval struct {
+	By string    `json:"by"`
+	At time.Time `json:"at"`
+}
+
+type approveRequest struct {
+	// Keys 要审批的 sku，为空时审批所有需要审批的 sku
+	Keys []string `json:"keys"`
+}
+
+// ApproveJob 审批需要审批的 sku，只有配置了的审批人可以调用
+func (a *Api) ApproveJob(c *gin.Context) {
+	by, ok := a.approver(c)
+	if !ok {
+		RespErr(c, nil, "没有审批权限")
+		return
+	}
+	job, err := a.jobs.Get(c.Param("id"))
+	if err != nil {
+		RespErr(c, err, "任务不存在")
+		return
+	}
+	// 整体检查在分析结束时才会加入需要审批的 sku
+	if job.CurrentStatus() != JobStatusParsed {
+		RespErr(c, ErrJobNotReady, "分析完成后才能审批")
+		return
+	}
+	req := &approveRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(req); err != nil && err != io.EOF {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	approved, unknown := job.Approve(req.Keys, by)
+	logrus.Infof("job %s: %s approved %d skus", job.ID, by, len(approved))
+	if len(unknown) > 0 {
+		RespErrData(c, nil, "部分 sku 不需要审批或者不存在", map[string]interface{}{
+			"approved": approved,
+			"unknown":  unknown,
+		})
+		return
+	}
+	Resp(c, map[string]interface{}{
+		"approved": approved,
+	})
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xuyuntech/inventory_sync_go/money"
+)
+
+func TestCheckSku(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy *GuardrailPolicy
+		sku    *goodUpdatedSku
+		cost   money.Money
+		want   []string
+	}{
+		{
+			name:   "disabled",
+			policy: &GuardrailPolicy{},
+			sku:    &goodUpdatedSku{Price: 1000, ToPrice: 1},
+			cost:   500,
+			want:   []string{},
+		},
+		{
+			name:   "price change within limit",
+			policy: &GuardrailPolicy{MaxPriceChangePercent: 20},
+			sku:    &goodUpdatedSku{Price: 1000, ToPrice: 1200},
+			want:   []string{},
+		},
+		{
+			name:   "price change over limit",
+			policy: &GuardrailPolicy{MaxPriceChangePercent: 20},
+			sku:    &goodUpdatedSku{Price: 1000, ToPrice: 790},
+			want:   []string{GuardrailPriceChange},
+		},
+		{
+			name:   "price from zero",
+			policy: &GuardrailPolicy{MaxPriceChangePercent: 20},
+			sku:    &goodUpdatedSku{Price: 0, ToPrice: 100},
+			want:   []string{GuardrailPriceChange},
+		},
+		{
+			name:   "below cost",
+			policy: &GuardrailPolicy{CheckCost: true},
+			sku:    &goodUpdatedSku{Price: 1000, ToPrice: 400},
+			cost:   500,
+			want:   []string{GuardrailBelowCost},
+		},
+		{
+			name:   "no cost",
+			policy: &GuardrailPolicy{CheckCost: true},
+			sku:    &goodUpdatedSku{Price: 1000, ToPrice: 400},
+			want:   []string{},
+		},
+		{
+			name:   "both",
+			policy: &GuardrailPolicy{MaxPriceChangePercent: 10, CheckCost: true},
+			sku:    &goodUpdatedSku{Price: 1000, ToPrice: 400},
+			cost:   500,
+			want:   []string{GuardrailPriceChange, GuardrailBelowCost},
+		},
+	}
+	for _, c := range cases {
+		if got := c.policy.checkSku(c.sku, c.cost); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: checkSku = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCheckResults(t *testing.T) {
+	results := []*goodUpdated{
+		{OfflineID: 1, OfflineName: "徐汇店", ItemID: 10, Skus: []*goodUpdatedSku{
+			{ID: 100, Quantity: 50, ToQuantity: 0},
+			{ID: 101, Quantity: 50, ToQuantity: 40},
+		}},
+		{OfflineID: 1, OfflineName: "徐汇店", ItemID: 11, Skus: []*goodUpdatedSku{
+			{ID: 110, Quantity: 0, ToQuantity: 0},
+			{ID: 111, Quantity: 0, ToQuantity: 10},
+		}},
+		{OfflineID: 2, OfflineName: "静安店", ItemID: 10, Skus: []*goodUpdatedSku{
+			{ID: 100, Quantity: 5, ToQuantity: 0},
+			{ID: 101, Quantity: 100, ToQuantity: 100},
+		}},
+	}
+	type violation struct {
+		rule string
+		keys []string
+	}
+	cases := []struct {
+		name   string
+		policy *GuardrailPolicy
+		want   []violation
+	}{
+		{
+			name:   "disabled",
+			policy: &GuardrailPolicy{},
+			want:   []violation{},
+		},
+		{
+			name:   "zeroed within limit",
+			policy: &GuardrailPolicy{MaxZeroedSkus: 2},
+			want:   []violation{},
+		},
+		{
+			name:   "zeroed over limit",
+			policy: &GuardrailPolicy{MaxZeroedSkus: 1},
+			want:   []violation{{rule: GuardrailZeroed, keys: []string{"10-1-100", "10-2-100"}}},
+		},
+		{
+			// 徐汇店 100 -> 50 下降 50%，静安店 105 -> 100 下降约 4.8%
+			name:   "store stock drop",
+			policy: &GuardrailPolicy{MaxStoreStockDropPercent: 30},
+			want:   []violation{{rule: GuardrailStockDrop, keys: []string{"10-1-100", "10-1-101"}}},
+		},
+		{
+			name:   "both stores drop",
+			policy: &GuardrailPolicy{MaxStoreStockDropPercent: 4},
+			want: []violation{
+				{rule: GuardrailStockDrop, keys: []string{"10-1-100", "10-1-101"}},
+				{rule: GuardrailStockDrop, keys: []string{"10-2-100"}},
+			},
+		},
+		{
+			name:   "drop exactly at limit",
+			policy: &GuardrailPolicy{MaxStoreStockDropPercent: 50},
+			want:   []violation{},
+		},
+	}
+	for _, c := range cases {
+		got := make([]violation, 0)
+		for _, v := range c.policy.checkResults(results) {
+			got = append(got, violation{rule: v.Rule, keys: v.Keys})
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: checkResults = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
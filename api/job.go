@@ -0,0 +1,595 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	JobStatusInit     = "init"
+	JobStatusParsing  = "parsing"
+	JobStatusParsed   = "parsed"
+	JobStatusFailed   = "failed"
+	JobStatusCanceled = "canceled"
+)
+
+var (
+	ErrJobNotFound = errors.New("Job not found")
+	ErrJobRunning  = errors.New("Job is running")
+	ErrJobNotReady = errors.New("Job is not parsed")
+	ErrJobApplying = errors.New("Job is applying")
+	ErrJobRestored = errors.New("Job is restored from a change plan")
+)
+
+// Job 一次库存文件上传及其分析结果
+type Job struct {
+	ID         string                 `json:"id"`
+	FileName   string                 `json:"file_name"`
+	Status     string                 `json:"status"`
+	Err        string                 `json:"err,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+	StartedAt  *time.Time             `json:"started_at,omitempty"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty"`
+	ItemsHash  map[string][]*ExcelRow `json:"-"`
+	// SkuRows 没有商品编码的行，key 为 sku 编码，分析时到有赞查找所属的商品
+	SkuRows map[string][]*ExcelRow `json:"-"`
+	// UploadReport 上传时的校验结果
+	UploadReport *uploadReport  `json:"-"`
+	Results      []*goodUpdated `json:"-"`
+	// Problems 分析时跳过的商品、门店和 sku
+	Problems        []*analysisEvent `json:"-"`
+	AnalysisSummary *analysisSummary `json:"-"`
+	// ApplyResults 写回有赞的结果
+	ApplyResults []*applyResult `json:"-"`
+	// Decisions 每个 sku 的审核结果，key 为 skuKey
+	Decisions map[string]string `json:"-"`
+	// Violations 分析结束时整体检查发现的问题，Holds 为因此需要审批的 sku 和原因
+	Violations []*guardrailViolation `json:"-"`
+	Holds      map[string][]string   `json:"-"`
+	// Approvals 需要审批的 sku 的审批记录
+	Approvals map[string]*approval `json:"-"`
+	// Plan 最近一次生成的修改计划
+	Plan *changePlan `json:"-"`
+	// Restored 由修改计划恢复的 job，没有库存文件，不能重新分析
+	Restored bool `json:"restored,omitempty"`
+	// events 最近一次分析输出的事件
+	events *eventLog
+	// cancel 取消正在进行的分析
+	cancel context.CancelFunc
+	// subscribers 正在接收事件的客户端数，都断开一段时间后取消分析
+	subscribers int
+	idleTimer   *time.Timer
+	// applying 正在写回有赞，同一个 job 同时只能有一次写回
+	applying bool
+	sync.RWMutex
+}
+
+// JobSummary 列表里展示的 job 信息
+type JobSummary struct {
+	ID          string     `json:"id"`
+	FileName    string     `json:"file_name"`
+	Status      string     `json:"status"`
+	Err         string     `json:"err,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	ItemCount   int        `json:"item_count"`
+	ResultCount int        `json:"result_count"`
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(b)
+}
+
+func (j *Job) Summary() *JobSummary {
+	j.RLock()
+	defer j.RUnlock()
+	return &JobSummary{
+		ID:          j.ID,
+		FileName:    j.FileName,
+		Status:      j.Status,
+		Err:         j.Err,
+		CreatedAt:   j.CreatedAt,
+		UpdatedAt:   j.UpdatedAt,
+		StartedAt:   j.StartedAt,
+		FinishedAt:  j.FinishedAt,
+		ItemCount:   len(j.ItemsHash) + len(j.SkuRows),
+		ResultCount: len(j.Results),
+	}
+}
+
+// Start 标记 job 开始分析并返回分析用的 ctx，正在分析的 job 不能重复开始
+func (j *Job) Start(parent context.Context, timeout time.Duration) (context.Context, error) {
+	j.Lock()
+	defer j.Unlock()
+	if j.Status == JobStatusParsing {
+		return nil, ErrJobRunning
+	}
+	if j.Restored {
+		return nil, ErrJobRestored
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	j.cancel = cancel
+	j.events = newEventLog()
+	now := time.Now()
+	j.Status = JobStatusParsing
+	j.Err = ""
+	j.StartedAt = &now
+	j.FinishedAt = nil
+	j.UpdatedAt = now
+	j.Results = make([]*goodUpdated, 0)
+	j.Problems = make([]*analysisEvent, 0)
+	j.AnalysisSummary = nil
+	j.Decisions = make(map[string]string)
+	j.Violations = make([]*guardrailViolation, 0)
+	j.Holds = make(map[string][]string)
+	j.Approvals = make(map[string]*approval)
+	j.Plan = nil
+	return ctx, nil
+}
+
+func (j *Job) CurrentStatus() string {
+	j.RLock()
+	defer j.RUnlock()
+	return j.Status
+}
+
+// Events 最近一次分析的事件，还没有分析过时返回 nil
+func (j *Job) Events() *eventLog {
+	j.RLock()
+	defer j.RUnlock()
+	return j.events
+}
+
+// Emit 输出一个事件，并记录到 job 的结果里
+func (j *Job) Emit(eventType string, data interface{}) *analysisEvent {
+	j.Lock()
+	defer j.Unlock()
+	e := j.events.Append(eventType, data)
+	switch eventType {
+	case EventDiff:
+		j.Results = append(j.Results, data.(*goodUpdated))
+	case EventDone:
+		j.AnalysisSummary = data.(*analysisSummary)
+	case EventGuardrail:
+		v := data.(*guardrailViolation)
+		j.Violations = append(j.Violations, v)
+		for _, key := range v.Keys {
+			j.Holds[key] = append(j.Holds[key], v.Rule)
+		}
+	case EventProgress, EventError:
+	default:
+		j.Problems = append(j.Problems, e)
+	}
+	j.UpdatedAt = time.Now()
+	return e
+}
+
+func (j *Job) Subscribe() {
+	j.Lock()
+	defer j.Unlock()
+	j.subscribers++
+	if j.idleTimer != nil {
+		j.idleTimer.Stop()
+		j.idleTimer = nil
+	}
+}
+
+// Unsubscribe 最后一个客户端断开 grace 之后还没有重连，就取消正在进行的分析
+func (j *Job) Unsubscribe(grace time.Duration) {
+	j.Lock()
+	defer j.Unlock()
+	j.subscribers--
+	if j.subscribers > 0 || j.Status != JobStatusParsing || j.cancel == nil {
+		return
+	}
+	cancel := j.cancel
+	j.idleTimer = time.AfterFunc(grace, func() {
+		logrus.Infof("job %s has no subscriber for %s, cancel it", j.ID, grace)
+		cancel()
+	})
+}
+
+const (
+	DecisionApproved = "approved"
+	DecisionRejected = "rejected"
+)
+
+func (j *Job) SetDecision(key string, decision string) {
+	j.Lock()
+	defer j.Unlock()
+	j.Decisions[key] = decision
+	j.UpdatedAt = time.Now()
+}
+
+// CurrentDecisions 审核结果的拷贝
+func (j *Job) CurrentDecisions() map[string]string {
+	j.RLock()
+	defer j.RUnlock()
+	decisions := make(map[string]string, len(j.Decisions))
+	for k, v := range j.Decisions {
+		decisions[k] = v
+	}
+	return decisions
+}
+
+// ShopNames 库存文件里出现的所有门店名称
+func (j *Job) ShopNames() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, hash := range []map[string][]*ExcelRow{j.ItemsHash, j.SkuRows} {
+		for _, rows := range hash {
+			for _, row := range rows {
+				if row.ShopName != "" && !seen[row.ShopName] {
+					seen[row.ShopName] = true
+					names = append(names, row.ShopName)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SelectSkus 从分析结果里挑出 keep 返回 true 的 sku，每个商品只保留选中的 sku
+func (j *Job) SelectSkus(keep func(gu *goodUpdated, sku *goodUpdatedSku) bool) []*goodUpdated {
+	j.RLock()
+	defer j.RUnlock()
+	goods := make([]*goodUpdated, 0)
+	for _, gu := range j.Results {
+		skus := make([]*goodUpdatedSku, 0)
+		for _, sku := range gu.Skus {
+			if keep(gu, sku) {
+				skus = append(skus, sku)
+			}
+		}
+		if len(skus) == 0 {
+			continue
+		}
+		selected := *gu
+		selected.Skus = skus
+		goods = append(goods, &selected)
+	}
+	return goods
+}
+
+// needsApproval 触发了检查规则并且还没有审批，调用方需要持有锁
+func (j *Job) needsApproval(key string, sku *goodUpdatedSku) bool {
+	if !sku.NeedsApproval && len(j.Holds[key]) == 0 {
+		return false
+	}
+	_, approved := j.Approvals[key]
+	return !approved
+}
+
+// Approve 审批 keys 对应的 sku，keys 为空时审批所有需要审批的 sku，返回审批了的和不需要审批或不存在的 key
+func (j *Job) Approve(keys []string, by string) (approved []string, unknown []string) {
+	j.Lock()
+	defer j.Unlock()
+	pending := make(map[string]bool)
+	for _, gu := range j.Results {
+		for _, sku := range gu.Skus {
+			key := skuKey(gu.ItemID, gu.OfflineID, sku.ID)
+			if j.needsApproval(key, sku) {
+				pending[key] = true
+			}
+		}
+	}
+	if len(keys) == 0 {
+		for key := range pending {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	approved = make([]string, 0)
+	unknown = make([]string, 0)
+	now := time.Now()
+	for _, key := range keys {
+		if !pending[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+		j.Approvals[key] = &approval{By: by, At: now}
+		approved = append(approved, key)
+	}
+	j.UpdatedAt = now
+	return approved, unknown
+}
+
+// ResolveApply 用分析保存的 diff 替换客户端提交的 sku，客户端只能选择 sku，不能修改目标值
+// 返回可以写回的商品、需要审批还没审批的 key、审核时被拒绝的 key 和分析结果里没有的 key
+func (j *Job) ResolveApply(goods []*goodUpdated) (selected []*goodUpdated, blocked, rejected, unknown []string) {
+	requested := make(map[string]bool)
+	for _, gu := range goods {
+		for _, sku := range gu.Skus {
+			requested[skuKey(gu.ItemID, gu.OfflineID, sku.ID)] = true
+		}
+	}
+	blocked = make([]string, 0)
+	rejected = make([]string, 0)
+	selected = j.SelectSkus(func(gu *goodUpdated, sku *goodUpdatedSku) bool {
+		key := skuKey(gu.ItemID, gu.OfflineID, sku.ID)
+		if !requested[key] {
+			return false
+		}
+		delete(requested, key)
+		if j.Decisions[key] == DecisionRejected {
+			rejected = append(rejected, key)
+			return false
+		}
+		if j.needsApproval(key, sku) {
+			blocked = append(blocked, key)
+			return false
+		}
+		return true
+	})
+	unknown = make([]string, 0, len(requested))
+	for key := range requested {
+		unknown = append(unknown, key)
+	}
+	sort.Strings(unknown)
+	return selected, blocked, rejected, unknown
+}
+
+func (j *Job) SetPlan(plan *changePlan) {
+	j.Lock()
+	defer j.Unlock()
+	j.Plan = plan
+	j.UpdatedAt = time.Now()
+}
+
+func (j *Job) CurrentPlan() *changePlan {
+	j.RLock()
+	defer j.RUnlock()
+	return j.Plan
+}
+
+// BeginApply 标记 job 开始写回，已经在写回时返回 ErrJobApplying，写回结束后调用 EndApply
+func (j *Job) BeginApply() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.applying {
+		return ErrJobApplying
+	}
+	j.applying = true
+	return nil
+}
+
+func (j *Job) EndApply() {
+	j.Lock()
+	defer j.Unlock()
+	j.applying = false
+}
+
+func (j *Job) AddApplyResult(result *applyResult) {
+	j.Lock()
+	defer j.Unlock()
+	j.ApplyResults = append(j.ApplyResults, result)
+	j.UpdatedAt = time.Now()
+}
+
+// Finish 结束分析，err 不为空时 job 标记为失败
+func (j *Job) Finish(status string, err error) {
+	j.Lock()
+	defer j.Unlock()
+	if j.cancel != nil {
+		j.cancel()
+	}
+	if j.idleTimer != nil {
+		j.idleTimer.Stop()
+		j.idleTimer = nil
+	}
+	j.events.Close()
+	now := time.Now()
+	j.Status = status
+	if err != nil {
+		j.Err = err.Error()
+	}
+	j.FinishedAt = &now
+	j.UpdatedAt = now
+}
+
+const (
+	// DefaultJobTTL job 最后一次更新之后保留的时间
+	DefaultJobTTL = time.Hour * 24
+	// DefaultMaxJobs 最多保留的 job 数
+	DefaultMaxJobs = 50
+)
+
+// JobStore 保存在内存中的所有 job
+// 创建新 job 时清理超过 ttl 没有更新的 job，数量超过 maxJobs 时从最早的开始清理，正在分析、写回或有客户端订阅的 job 不会被清理
+type JobStore struct {
+	jobs    map[string]*Job
+	ttl     time.Duration
+	maxJobs int
+	sync.RWMutex
+}
+
+func NewJobStore(ttl time.Duration, maxJobs int) *JobStore {
+	if ttl <= 0 {
+		ttl = DefaultJobTTL
+	}
+	if maxJobs <= 0 {
+		maxJobs = DefaultMaxJobs
+	}
+	return &JobStore{
+		jobs:    make(map[string]*Job),
+		ttl:     ttl,
+		maxJobs: maxJobs,
+	}
+}
+
+// evictable 没有在分析、写回，也没有客户端订阅，返回最后一次更新的时间
+func (j *Job) evictable() (time.Time, bool) {
+	j.RLock()
+	defer j.RUnlock()
+	return j.UpdatedAt, j.Status != JobStatusParsing && !j.applying && j.subscribers == 0
+}
+
+// evict 清理过期和超出数量的 job，调用方需要持有锁
+func (s *JobStore) evict(now time.Time) {
+	candidates := make([]*Job, 0)
+	updated := make(map[*Job]time.Time)
+	for id, job := range s.jobs {
+		at, ok := job.evictable()
+		if !ok {
+			continue
+		}
+		if now.Sub(at) > s.ttl {
+			delete(s.jobs, id)
+			logrus.Infof("job %s evicted, last updated at %s", id, at.Format(time.RFC3339))
+			continue
+		}
+		updated[job] = at
+		candidates = append(candidates, job)
+	}
+	sort.Slice(candidates, func(i, k int) bool {
+		return updated[candidates[i]].Before(updated[candidates[k]])
+	})
+	for _, job := range candidates {
+		if len(s.jobs) < s.maxJobs {
+			break
+		}
+		delete(s.jobs, job.ID)
+		logrus.Infof("job %s evicted, more than %d jobs", job.ID, s.maxJobs)
+	}
+}
+
+func (s *JobStore) Create(fileName string, itemsHash, skuRows map[string][]*ExcelRow, report *uploadReport) *Job {
+	now := time.Now()
+	job := &Job{
+		ID:           newJobID(),
+		FileName:     fileName,
+		Status:       JobStatusInit,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ItemsHash:    itemsHash,
+		SkuRows:      skuRows,
+		UploadReport: report,
+		Results:      make([]*goodUpdated, 0),
+		ApplyResults: make([]*applyResult, 0),
+		Decisions:    make(map[string]string),
+		Violations:   make([]*guardrailViolation, 0),
+		Holds:        make(map[string][]string),
+		Approvals:    make(map[string]*approval),
+	}
+	s.Lock()
+	s.evict(now)
+	s.jobs[job.ID] = job
+	s.Unlock()
+	return job
+}
+
+// Restore 用签名校验过的修改计划恢复已经不存在的 job，恢复的 job 没有库存文件，只用于按计划写回
+func (s *JobStore) Restore(plan *changePlan) *Job {
+	s.Lock()
+	defer s.Unlock()
+	if job, ok := s.jobs[plan.JobID]; ok {
+		return job
+	}
+	now := time.Now()
+	job := &Job{
+		ID:           plan.JobID,
+		FileName:     fmt.Sprintf("plan-%s.json", plan.JobID),
+		Status:       JobStatusParsed,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ItemsHash:    make(map[string][]*ExcelRow),
+		SkuRows:      make(map[string][]*ExcelRow),
+		Results:      make([]*goodUpdated, 0),
+		ApplyResults: make([]*applyResult, 0),
+		Decisions:    make(map[string]string),
+		Violations:   make([]*guardrailViolation, 0),
+		Holds:        make(map[string][]string),
+		Approvals:    make(map[string]*approval),
+		Plan:         plan,
+		Restored:     true,
+		events:       newEventLog(),
+	}
+	// 没有分析事件，订阅的客户端直接结束
+	job.events.Close()
+	s.evict(now)
+	s.jobs[job.ID] = job
+	return job
+}
+
+func (s *JobStore) Get(id string) (*Job, error) {
+	s.RLock()
+	defer s.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// List 按创建时间倒序返回所有 job
+func (s *JobStore) List() []*Job {
+	s.RLock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.RUnlock()
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].CreatedAt.After(jobs[k].CreatedAt)
+	})
+	return jobs
+}
+
+func (a *Api) ListJobs(c *gin.Context) {
+	jobs := a.jobs.List()
+	summaries := make([]*JobSummary, 0, len(jobs))
+	for _, job := range jobs {
+		summaries = append(summaries, job.Summary())
+	}
+	Resp(c, summaries)
+}
+
+func (a *Api) GetJob(c *gin.Context) {
+	job, err := a.jobs.Get(c.Param("id"))
+	if err != nil {
+		RespErr(c, err, "任务不存在")
+		return
+	}
+	job.RLock()
+	results := job.Results
+	problems := job.Problems
+	summary := job.AnalysisSummary
+	applyResults := job.ApplyResults
+	violations := job.Violations
+	holds := make(map[string][]string, len(job.Holds))
+	for k, v := range job.Holds {
+		holds[k] = v
+	}
+	approvals := make(map[string]*approval, len(job.Approvals))
+	for k, v := range job.Approvals {
+		approvals[k] = v
+	}
+	job.RUnlock()
+	Resp(c, map[string]interface{}{
+		"job":           job.Summary(),
+		"results":       results,
+		"problems":      problems,
+		"summary":       summary,
+		"apply_results": applyResults,
+		"decisions":     job.CurrentDecisions(),
+		"upload_report": job.UploadReport,
+		"violations":    violations,
+		"holds":         holds,
+		"approvals":     approvals,
+	})
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/xuyuntech/inventory_sync_go/money"
+)
+
+var (
+	ErrPlanNotFound     = errors.New("Change plan not found")
+	ErrPlanHashMismatch = errors.New("Change plan hash mismatch")
+	ErrPlanSignature    = errors.New("Change plan signature invalid")
+	ErrPlanJobMismatch  = errors.New("Change plan belongs to another job")
+)
+
+// planChange 计划中一个 sku 的修改前后的值
+type planChange struct {
+	Key         string      `json:"key"`
+	ItemID      int64       `json:"item_id"`
+	ItemTitle   string      `json:"item_title"`
+	ItemNo      string      `json:"item_no"`
+	OfflineID   int64       `json:"offline_id"`
+	OfflineName string      `json:"offline_name"`
+	SkuID       int64       `json:"sku_id"`
+	OuterID     string      `json:"outer_id"`
+	Name        string      `json:"name"`
+	Price       money.Money `json:"price"`
+	ToPrice     money.Money `json:"to_price"`
+	Quantity    money.Stock `json:"quantity"`
+	ToQuantity  money.Stock `json:"to_quantity"`
+	Changed     []string    `json:"changed"`
+}
+
+// changePlan 审核后冻结的修改计划，写回时按计划里的值原样执行
+// Hash 为 JobID 和 Changes 的 sha256，配置了 PlanSecret 时 Signature 为 Hash 的 HMAC-SHA256
+type changePlan struct {
+	JobID     string        `json:"job_id"`
+	CreatedAt time.Time     `json:"created_at"`
+	CreatedBy string        `json:"created_by,omitempty"`
+	Changes   []*planChange `json:"changes"`
+	Hash      string        `json:"hash"`
+	Signature string        `json:"signature,omitempty"`
+}
+
+func newChangePlan(jobID string, goods []*goodUpdated) *changePlan {
+	changes := make([]*planChange, 0)
+	for _, gu := range goods {
+		for _, sku := range gu.Skus {
+			changes = append(changes, &planChange{
+				Key:         skuKey(gu.ItemID, gu.OfflineID, sku.ID),
+				ItemID:      gu.ItemID,
+				ItemTitle:   gu.ItemTitle,
+				ItemNo:      gu.ItemNo,
+				OfflineID:   gu.OfflineID,
+				OfflineName: gu.OfflineName,
+				SkuID:       sku.ID,
+				OuterID:     sku.OuterID,
+				Name:        sku.Name,
+				Price:       sku.Price,
+				ToPrice:     sku.ToPrice,
+				Quantity:    sku.Quantity,
+				ToQuantity:  sku.ToQuantity,
+				Changed:     sku.Changed,
+			})
+		}
+	}
+	sort.Slice(changes, func(i, k int) bool {
+		return changes[i].Key < changes[k].Key
+	})
+	p := &changePlan{
+		JobID:     jobID,
+		CreatedAt: time.Now(),
+		Changes:   changes,
+	}
+	p.Hash = p.computeHash()
+	return p
+}
+
+// computeHash 只对 JobID 和 Changes 计算，创建时间和创建人不影响计划内容
+func (p *changePlan) computeHash() string {
+	b, _ := json.Marshal(struct {
+		JobID   string        `json:"job_id"`
+		Changes []*planChange `json:"changes"`
+	}{p.JobID, p.Changes})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *changePlan) sign(secret string) {
+	if secret == "" {
+		return
+	}
+	p.Signature = planSignature(secret, p.Hash)
+}
+
+func planSignature(secret, hash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 检查计划内容没有被修改，并且和审核时的 hash 一致
+func (p *changePlan) Verify(hash string, secret string) error {
+	if p.computeHash() != p.Hash || hash != p.Hash {
+		return ErrPlanHashMismatch
+	}
+	if secret != "" && !hmac.Equal([]byte(planSignature(secret, p.Hash)), []byte(p.Signature)) {
+		return ErrPlanSignature
+	}
+	return nil
+}
+
+// goods 把计划转换为写回用的 goodUpdated，To 值使用计划里的值
+func (p *changePlan) goods() []*goodUpdated {
+	goods := make([]*goodUpdated, 0)
+	index := make(map[string]*goodUpdated)
+	for _, c := range p.Changes {
+		key := fmt.Sprintf("%d-%d", c.ItemID, c.OfflineID)
+		gu, ok := index[key]
+		if !ok {
+			gu = &goodUpdated{
+				OfflineID:   c.OfflineID,
+				OfflineName: c.OfflineName,
+				ItemID:      c.ItemID,
+				ItemTitle:   c.ItemTitle,
+				ItemNo:      c.ItemNo,
+				Skus:        make([]*goodUpdatedSku, 0),
+			}
+			index[key] = gu
+			goods = append(goods, gu)
+		}
+		gu.Skus = append(gu.Skus, &goodUpdatedSku{
+			ID:         c.SkuID,
+			OuterID:    c.OuterID,
+			Name:       c.Name,
+			Price:      c.Price,
+			ToPrice:    c.ToPrice,
+			Quantity:   c.Quantity,
+			ToQuantity: c.ToQuantity,
+			Changed:    c.Changed,
+		})
+	}
+	return goods
+}
+
+type createPlanRequest struct {
+	// Keys 计划包含的 sku，为空时包含所有分析结果
+	Keys []string `json:"keys"`
+}
+
+// CreatePlan 把分析结果冻结为修改计划，需要审批的 sku 审批后才能进入计划
+func (a *Api) CreatePlan(c *gin.Context) {
+	job, err := a.jobs.Get(c.Param("id"))
+	if err != nil {
+		RespErr(c, err, "任务不存在")
+		return
+	}
+	if job.CurrentStatus() != JobStatusParsed {
+		RespErr(c, ErrJobNotReady, "分析完成后才能生成修改计划")
+		return
+	}
+	req := &createPlanRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(req); err != nil && err != io.EOF {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	keys := make(map[string]bool)
+	for _, key := range req.Keys {
+		keys[key] = true
+	}
+	goods := job.SelectSkus(func(gu *goodUpdated, sku *goodUpdatedSku) bool {
+		return len(keys) == 0 || keys[skuKey(gu.ItemID, gu.OfflineID, sku.ID)]
+	})
+	goods, blocked, rejected, unknown := job.ResolveApply(goods)
+	if len(blocked) > 0 || len(rejected) > 0 || len(unknown) > 0 {
+		RespErrData(c, nil, "部分 sku 需要审批、已被拒绝或者不在分析结果里", map[string]interface{}{
+			"blocked":  blocked,
+			"rejected": rejected,
+			"unknown":  unknown,
+		})
+		return
+	}
+	plan := newChangePlan(job.ID, goods)
+	if len(plan.Changes) == 0 {
+		RespErr(c, nil, "没有需要同步的 sku")
+		return
+	}
+	plan.CreatedBy, _ = a.approver(c)
+	plan.sign(a.planSecret)
+	job.SetPlan(plan)
+	logrus.Infof("job %s: change plan %s created with %d changes", job.ID, plan.Hash, len(plan.Changes))
+	Resp(c, plan)
+}
+
+// GetPlan 返回 job 的修改计划，download=true 时作为 json 文件下载
+func (a *Api) GetPlan(c *gin.Context) {
+	job, err := a.jobs.Get(c.Param("id"))
+	if err != nil {
+		RespErr(c, err, "任务不存在")
+		return
+	}
+	plan := job.CurrentPlan()
+	if plan == nil {
+		RespErr(c, ErrPlanNotFound, "还没有生成修改计划")
+		return
+	}
+	if c.Query("download") == "true" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=plan-%s.json", job.ID))
+		c.IndentedJSON(200, plan)
+		return
+	}
+	Resp(c, plan)
+}
+
+type applyPlanRequest struct {
+	// Hash 审核时看到的计划 hash，和当前计划不一致时拒绝写回
+	Hash   string `json:"hash"`
+	DryRun bool   `json:"dry_run"`
+	// Plan 下载的计划文件，为空时使用服务端保存的计划
+	// 配置了 PlanSecret 时按签名校验，job 已经不存在（例如服务重启）时也可以写回
+	Plan *changePlan `json:"plan"`
+}
+
+// ApplyPlan 按修改计划原样写回有赞，dry_run 时只返回将要发出的请求
+func (a *Api) ApplyPlan(c *gin.Context) {
+	req := &applyPlanRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(req); err != nil {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	job, plan, err := a.resolvePlan(c.Param("id"), req)
+	if err != nil {
+		RespErr(c, err, planErrMsg(err))
+		return
+	}
+	tasks := a.buildApplyTasks(plan.goods())
+	if req.DryRun || c.Query("dry_run") == "true" {
+		Resp(c, map[string]interface{}{
+			"hash":     plan.Hash,
+			"requests": dryRunRequests(tasks),
+		})
+		return
+	}
+	if err := job.BeginApply(); err != nil {
+		RespErr(c, err, "正在写回，请等待上一次写回结束")
+		return
+	}
+	defer job.EndApply()
+	a.streamApply(c, job, tasks)
+}
+
+func planErrMsg(err error) string {
+	switch err {
+	case ErrJobNotFound:
+		return "任务不存在"
+	case ErrJobNotReady:
+		return "分析完成后才能写回"
+	case ErrPlanNotFound:
+		return "还没有生成修改计划"
+	case ErrPlanJobMismatch:
+		return "修改计划不属于这个任务"
+	case ErrPlanSignature:
+		return "修改计划签名不正确"
+	}
+	return "修改计划已经变化，请重新审核"
+}
+
+// resolvePlan 返回要写回的 job 和校验过的计划
+// 没有提交计划文件时使用服务端保存的计划；提交了计划文件时，job 存在则只接受和服务端当前计划相同的文件，
+// job 不存在（例如服务重启）时只接受 PlanSecret 签名校验通过的文件
+func (a *Api) resolvePlan(jobID string, req *applyPlanRequest) (*Job, *changePlan, error) {
+	job, err := a.jobs.Get(jobID)
+	if req.Plan == nil {
+		if err != nil {
+			return nil, nil, err
+		}
+		if job.CurrentStatus() != JobStatusParsed {
+			return nil, nil, ErrJobNotReady
+		}
+		plan := job.CurrentPlan()
+		if plan == nil {
+			return nil, nil, ErrPlanNotFound
+		}
+		if err := plan.Verify(req.Hash, a.planSecret); err != nil {
+			return nil, nil, err
+		}
+		return job, plan, nil
+	}
+
+	plan := req.Plan
+	if plan.JobID != jobID {
+		return nil, nil, ErrPlanJobMismatch
+	}
+	hash := req.Hash
+	if hash == "" {
+		hash = plan.Hash
+	}
+	if err := plan.Verify(hash, a.planSecret); err != nil {
+		return nil, nil, err
+	}
+	if err != nil {
+		if a.planSecret == "" {
+			return nil, nil, err
+		}
+		job = a.jobs.Restore(plan)
+		logrus.Infof("job %s restored from signed change plan %s", job.ID, plan.Hash)
+		return job, plan, nil
+	}
+	// job 还在时只接受当前的计划，重新分析或审批后旧的计划文件不能再写回
+	if job.CurrentStatus() != JobStatusParsed {
+		return nil, nil, ErrJobNotReady
+	}
+	if current := job.CurrentPlan(); current == nil || current.Hash != plan.Hash {
+		return nil, nil, ErrPlanHashMismatch
+	}
+	return job, plan, nil
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testGoods() []*goodUpdated {
+	return []*goodUpdated{
+		{OfflineID: 2, OfflineName: "静安店", ItemID: 10, ItemTitle: "T恤", Skus: []*goodUpdatedSku{
+			{ID: 100, Price: 1000, ToPrice: 1000, Quantity: 5, ToQuantity: 3, Changed: []string{ChangeQuantity}},
+		}},
+		{OfflineID: 1, OfflineName: "徐汇店", ItemID: 10, ItemTitle: "T恤", Skus: []*goodUpdatedSku{
+			{ID: 101, Price: 1000, ToPrice: 1200, Quantity: 5, ToQuantity: 5, Changed: []string{ChangePrice}},
+			{ID: 100, Price: 1000, ToPrice: 1000, Quantity: 5, ToQuantity: 0, Changed: []string{ChangeQuantity}},
+		}},
+	}
+}
+
+func TestNewChangePlan(t *testing.T) {
+	p := newChangePlan("job1", testGoods())
+	keys := make([]string, 0)
+	for _, c := range p.Changes {
+		keys = append(keys, c.Key)
+	}
+	if want := "10-1-100,10-1-101,10-2-100"; strings.Join(keys, ",") != want {
+		t.Errorf("changes = %s, want %s", strings.Join(keys, ","), want)
+	}
+	if p.Hash == "" || p.Hash != p.computeHash() {
+		t.Errorf("hash = %q, want computeHash()", p.Hash)
+	}
+
+	// 商品顺序和创建时间不影响 hash
+	goods := testGoods()
+	goods[0], goods[1] = goods[1], goods[0]
+	other := newChangePlan("job1", goods)
+	other.CreatedAt = other.CreatedAt.Add(time.Hour)
+	other.CreatedBy = "someone"
+	if other.computeHash() != p.Hash {
+		t.Error("hash changed with goods order or creation time")
+	}
+	if newChangePlan("job2", testGoods()).Hash == p.Hash {
+		t.Error("hash does not include the job id")
+	}
+
+	back := p.goods()
+	if len(back) != 2 || len(back[0].Skus) != 2 || back[0].OfflineID != 1 || back[0].Skus[1].ToPrice != 1200 {
+		t.Errorf("goods() = %+v", back)
+	}
+}
+
+func TestChangePlanVerify(t *testing.T) {
+	const secret = "s3cret"
+	cases := []struct {
+		name   string
+		secret string
+		modify func(p *changePlan) string
+		want   error
+	}{
+		{
+			name:   "signed",
+			secret: secret,
+			modify: func(p *changePlan) string { return p.Hash },
+		},
+		{
+			name:   "no secret ignores signature",
+			modify: func(p *changePlan) string { p.Signature = "bad"; return p.Hash },
+		},
+		{
+			name:   "other hash",
+			secret: secret,
+			modify: func(p *changePlan) string { return "other" },
+			want:   ErrPlanHashMismatch,
+		},
+		{
+			name:   "changed quantity",
+			secret: secret,
+			modify: func(p *changePlan) string { p.Changes[0].ToQuantity = 100; return p.Hash },
+			want:   ErrPlanHashMismatch,
+		},
+		{
+			name:   "changed job",
+			secret: secret,
+			modify: func(p *changePlan) string { p.JobID = "job2"; return p.Hash },
+			want:   ErrPlanHashMismatch,
+		},
+		{
+			name:   "rehashed without secret",
+			secret: secret,
+			modify: func(p *changePlan) string {
+				p.Changes[0].ToQuantity = 100
+				p.Hash = p.computeHash()
+				return p.Hash
+			},
+			want: ErrPlanSignature,
+		},
+		{
+			name:   "missing signature",
+			secret: secret,
+			modify: func(p *changePlan) string { p.Signature = ""; return p.Hash },
+			want:   ErrPlanSignature,
+		},
+	}
+	for _, c := range cases {
+		p := newChangePlan("job1", testGoods())
+		p.sign(c.secret)
+		// 计划会被下载后再提交，经过一次 json 编解码
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submitted := &changePlan{}
+		if err := json.Unmarshal(b, submitted); err != nil {
+			t.Fatal(err)
+		}
+		hash := c.modify(submitted)
+		if err := submitted.Verify(hash, c.secret); err != c.want {
+			t.Errorf("%s: Verify = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestChangePlanSign(t *testing.T) {
+	p := newChangePlan("job1", testGoods())
+	p.sign("")
+	if p.Signature != "" {
+		t.Errorf("sign without secret = %q, want empty", p.Signature)
+	}
+	p.sign("a")
+	a := p.Signature
+	p.sign("b")
+	if a == "" || a == p.Signature {
+		t.Errorf("signatures with different secrets: %q, %q", a, p.Signature)
+	}
+}
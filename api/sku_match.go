@@ -0,0 +1,210 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	limitedRequest "github.com/xuyuntech/inventory_sync_go/limited_request"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+	"golang.org/x/sync/errgroup"
+)
+
+// skuRowMatcher 为有赞 sku 找库存文件里对应的行
+// 优先按 sku 编码，其次按规格组合（匹配的规格越多越优先），最后使用没有 sku 编码和规格的商品行
+type skuRowMatcher struct {
+	itemRow      *ExcelRow
+	skuRows      map[string]*ExcelRow
+	propertyRows []*ExcelRow
+	matched      map[*ExcelRow]bool
+}
+
+func newSkuRowMatcher(rows []*ExcelRow) *skuRowMatcher {
+	m := &skuRowMatcher{
+		skuRows:      make(map[string]*ExcelRow),
+		propertyRows: make([]*ExcelRow, 0),
+		matched:      make(map[*ExcelRow]bool),
+	}
+	for _, row := range rows {
+		switch {
+		case row.SkuNO != "":
+			m.skuRows[row.SkuNO] = row
+		case len(row.Properties) > 0:
+			m.propertyRows = append(m.propertyRows, row)
+		default:
+			m.itemRow = row
+		}
+	}
+	return m
+}
+
+// Match 返回 sku 对应的行，没有时返回 nil
+func (m *skuRowMatcher) Match(sku *youzan.GoodsSku, properties []*youzan.GoodSkuProperty) *ExcelRow {
+	if row, ok := m.skuRows[sku.OuterID]; ok && sku.OuterID != "" {
+		m.matched[row] = true
+		return row
+	}
+	var best *ExcelRow
+	for _, row := range m.propertyRows {
+		if matchProperties(row.Properties, properties) && (best == nil || len(row.Properties) > len(best.Properties)) {
+			best = row
+		}
+	}
+	if best != nil {
+		m.matched[best] = true
+		return best
+	}
+	return m.itemRow
+}
+
+// Unmatched 按 sku 编码或规格指定、但没有对应有赞 sku 的行
+func (m *skuRowMatcher) Unmatched() []*ExcelRow {
+	rows := make([]*ExcelRow, 0)
+	for _, row := range m.skuRows {
+		if !m.matched[row] {
+			rows = append(rows, row)
+		}
+	}
+	for _, row := range m.propertyRows {
+		if !m.matched[row] {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// matchProperties 行里写的每个规格都和 sku 的规格一致
+func matchProperties(want map[string]string, properties []*youzan.GoodSkuProperty) bool {
+	for k, v := range want {
+		found := false
+		for _, p := range properties {
+			if strings.TrimSpace(p.K) == k && strings.TrimSpace(p.V) == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// propertiesLabel 规格组合的展示形式，例如 "颜色:红 尺码:XL"
+func propertiesLabel(properties []*youzan.GoodSkuProperty) string {
+	parts := make([]string, 0, len(properties))
+	for _, p := range properties {
+		parts = append(parts, p.K+":"+p.V)
+	}
+	return strings.Join(parts, " ")
+}
+
+type skuCustomResponse struct {
+	Response struct {
+		Skus []*struct {
+			NumIID  int64  `json:"num_iid"`
+			SkuID   int64  `json:"sku_id"`
+			OuterID string `json:"outer_id"`
+		} `json:"skus"`
+	} `json:"response"`
+}
+
+// resolveSkuRows 按 sku 编码到有赞查找没有商品编码的行所属的商品，返回有赞商品 ID 到行的映射
+// 找不到或者对应多个商品的 sku 编码输出 EventUnmatchedSku，ctx 结束时返回已经找到的部分
+func (a *Api) resolveSkuRows(ctx context.Context, skuRows map[string][]*ExcelRow, emit emitFunc) map[int64][]*ExcelRow {
+	itemRows := make(map[int64][]*ExcelRow)
+	if len(skuRows) == 0 {
+		return itemRows
+	}
+	tasks := make([]*limitedRequest.Task, 0, len(skuRows))
+	for skuNo := range skuRows {
+		tasks = append(tasks, &limitedRequest.Task{
+			ID:     skuNo,
+			URL:    a.youzan.URL("youzan.skus.custom", "3.0.0", "get"),
+			Method: "GET",
+			Params: map[string]string{
+				"outer_id": skuNo,
+			},
+		})
+	}
+	logrus.Infof("===== Start to resolve %d sku codes from youzan. ====", len(tasks))
+
+	lreq := a.newYouzanRequest()
+	unmatched := func(skuNo string, msg string, err error) {
+		for _, row := range skuRows[skuNo] {
+			p := &analysisProblem{
+				OfflineID: row.OfflineID,
+				ShopName:  row.ShopName,
+				Msg:       msg,
+			}
+			if err != nil {
+				emit(EventYouzanError, newYouzanProblem(p, err))
+				continue
+			}
+			emit(EventUnmatchedSku, p)
+		}
+	}
+
+	var g errgroup.Group
+	g.Go(func() error {
+		lreq.Add(ctx, tasks)
+		return nil
+	})
+	g.Go(func() error {
+		err := lreq.Start(ctx)
+		logrus.Debugf("LimitedRequest ended with err: %v", err)
+		return nil
+	})
+	g.Go(func() error {
+		defer lreq.Stop()
+		results := lreq.Results()
+		for processed := 0; processed < len(tasks); processed++ {
+			select {
+			case task := <-results:
+				skuNo := task.ID
+				itemIDs, err := parseSkuCustom(task)
+				switch {
+				case err != nil:
+					logrus.Errorf("task %s resolve sku failed: %v", task.ID, err)
+					unmatched(skuNo, fmt.Sprintf("按 sku 编码[%s]查找有赞商品失败: %v", skuNo, err), err)
+				case len(itemIDs) == 0:
+					unmatched(skuNo, fmt.Sprintf("有赞里没有 sku 编码为[%s]的 sku", skuNo), nil)
+				case len(itemIDs) > 1:
+					unmatched(skuNo, fmt.Sprintf("sku 编码[%s]对应多个有赞商品，请填写商品编码", skuNo), nil)
+				default:
+					itemRows[itemIDs[0]] = append(itemRows[itemIDs[0]], skuRows[skuNo]...)
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+	g.Wait()
+	return itemRows
+}
+
+// parseSkuCustom 返回 sku 编码对应的不重复的有赞商品 ID
+func parseSkuCustom(task *limitedRequest.Task) ([]int64, error) {
+	if task.Err != nil {
+		return nil, task.Err
+	}
+	if ye := youzan.DecodeError(task.Body); ye != nil {
+		return nil, ye
+	}
+	resp := &skuCustomResponse{}
+	if err := json.Unmarshal(task.Body, resp); err != nil {
+		return nil, err
+	}
+	itemIDs := make([]int64, 0, 1)
+	seen := make(map[int64]bool)
+	for _, sku := range resp.Response.Skus {
+		if sku.OuterID == task.ID && !seen[sku.NumIID] {
+			seen[sku.NumIID] = true
+			itemIDs = append(itemIDs, sku.NumIID)
+		}
+	}
+	return itemIDs, nil
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	limitedRequest "github.com/xuyuntech/inventory_sync_go/limited_request"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+func props(kv ...string) []*youzan.GoodSkuProperty {
+	ps := make([]*youzan.GoodSkuProperty, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		ps = append(ps, &youzan.GoodSkuProperty{K: kv[i], V: kv[i+1]})
+	}
+	return ps
+}
+
+func TestSkuRowMatcher(t *testing.T) {
+	item := &ExcelRow{ItemNO: "A1", Quantity: 1}
+	bySku := &ExcelRow{ItemNO: "A1", SkuNO: "S1", Quantity: 2}
+	red := &ExcelRow{ItemNO: "A1", Quantity: 3, Properties: map[string]string{"颜色": "红"}}
+	redXL := &ExcelRow{ItemNO: "A1", Quantity: 4, Properties: map[string]string{"颜色": "红", "尺码": "XL"}}
+	unknownSku := &ExcelRow{ItemNO: "A1", SkuNO: "S9", Quantity: 5}
+	blue := &ExcelRow{ItemNO: "A1", Quantity: 6, Properties: map[string]string{"颜色": "蓝"}}
+
+	cases := []struct {
+		name       string
+		rows       []*ExcelRow
+		sku        *youzan.GoodsSku
+		properties []*youzan.GoodSkuProperty
+		want       *ExcelRow
+	}{
+		{name: "sku no", rows: []*ExcelRow{item, bySku, redXL}, sku: &youzan.GoodsSku{OuterID: "S1"}, properties: props("颜色", "红", "尺码", "XL"), want: bySku},
+		{name: "most properties", rows: []*ExcelRow{item, red, redXL}, sku: &youzan.GoodsSku{OuterID: "S2"}, properties: props("颜色", " 红 ", "尺码", "XL"), want: redXL},
+		{name: "partial properties", rows: []*ExcelRow{item, red, redXL}, sku: &youzan.GoodsSku{}, properties: props("颜色", "红", "尺码", "M"), want: red},
+		{name: "item row", rows: []*ExcelRow{item, red}, sku: &youzan.GoodsSku{}, properties: props("颜色", "蓝"), want: item},
+		{name: "nothing", rows: []*ExcelRow{red}, sku: &youzan.GoodsSku{}, properties: props("颜色", "蓝"), want: nil},
+	}
+	for _, c := range cases {
+		m := newSkuRowMatcher(c.rows)
+		if got := m.Match(c.sku, c.properties); got != c.want {
+			t.Errorf("%s: Match = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	m := newSkuRowMatcher([]*ExcelRow{item, bySku, unknownSku, red, blue})
+	m.Match(&youzan.GoodsSku{OuterID: "S1"}, props("颜色", "红"))
+	m.Match(&youzan.GoodsSku{OuterID: "S2"}, props("颜色", "红"))
+	m.Match(&youzan.GoodsSku{OuterID: "S3"}, props("颜色", "绿"))
+	unmatched := m.Unmatched()
+	quantities := make([]int, 0, len(unmatched))
+	for _, row := range unmatched {
+		quantities = append(quantities, int(row.Quantity))
+	}
+	sort.Ints(quantities)
+	// 商品行不会出现在 Unmatched 里
+	if want := []int{5, 6}; !reflect.DeepEqual(quantities, want) {
+		t.Errorf("Unmatched quantities = %v, want %v", quantities, want)
+	}
+}
+
+func TestParseSkuCustom(t *testing.T) {
+	errTask := errors.New("timeout")
+	cases := []struct {
+		name string
+		task *limitedRequest.Task
+		want []int64
+		err  bool
+	}{
+		{
+			name: "one item",
+			task: &limitedRequest.Task{ID: "S1", Body: []byte(`{"response":{"skus":[{"num_iid":1,"sku_id":11,"outer_id":"S1"},{"num_iid":1,"sku_id":12,"outer_id":"S1"}]}}`)},
+			want: []int64{1},
+		},
+		{
+			name: "several items",
+			task: &limitedRequest.Task{ID: "S1", Body: []byte(`{"response":{"skus":[{"num_iid":1,"outer_id":"S1"},{"num_iid":2,"outer_id":"S1"}]}}`)},
+			want: []int64{1, 2},
+		},
+		{
+			name: "other outer id is ignored",
+			task: &limitedRequest.Task{ID: "S1", Body: []byte(`{"response":{"skus":[{"num_iid":1,"outer_id":"S10"}]}}`)},
+			want: []int64{},
+		},
+		{
+			name: "no skus",
+			task: &limitedRequest.Task{ID: "S1", Body: []byte(`{"response":{}}`)},
+			want: []int64{},
+		},
+		{
+			name: "youzan error",
+			task: &limitedRequest.Task{ID: "S1", Body: []byte(`{"error_response":{"code":40010,"msg":"invalid"}}`)},
+			err:  true,
+		},
+		{
+			name: "task error",
+			task: &limitedRequest.Task{ID: "S1", Err: errTask},
+			err:  true,
+		},
+		{
+			name: "bad body",
+			task: &limitedRequest.Task{ID: "S1", Body: []byte(`<html>`)},
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		got, err := parseSkuCustom(c.task)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: parseSkuCustom = %v, want error", c.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseSkuCustom error: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: parseSkuCustom = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+func setSSEHeaders(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", sse.ContentType)
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+}
+
+// writeSSE 按 Server-Sent Events 格式写出一个事件
+func writeSSE(w gin.ResponseWriter, e *analysisEvent) error {
+	event := sse.Event{
+		Event: e.Type,
+		Data:  e.Data,
+	}
+	if e.ID > 0 {
+		event.Id = strconv.Itoa(e.ID)
+	}
+	if err := sse.Encode(w, event); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// writeSSEPing 写一行注释保持连接，EventSource 会忽略它
+func writeSSEPing(w gin.ResponseWriter) {
+	io.WriteString(w, ": ping\n\n")
+	w.Flush()
+}
+
+// lastEventID 重连时浏览器通过 Last-Event-ID 带上最后收到的事件 ID，也可以用 last_event_id 参数指定
+// gin 的 GetHeader 不会把 key 转成 Last-Event-Id，所以用 Header.Get
+func lastEventID(c *gin.Context) int {
+	s := c.Request.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = c.Query("last_event_id")
+	}
+	id, _ := strconv.Atoi(s)
+	return id
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+// storeMatch 库存文件里的一行对应的有赞门店
+type storeMatch struct {
+	OfflineID string
+	// Name 有赞里的门店名称
+	Name string
+	// Mismatch 门店 ID 和门店名称对不上时的说明，门店仍然按 OfflineID 处理
+	Mismatch string
+}
+
+// matchStore 优先按门店 ID 查找，没有 ID 或者 ID 不存在时再按门店名称和门店别名查找
+func matchStore(offlines *youzan.Offlines, aliases *AliasStore, row *ExcelRow) (*storeMatch, error) {
+	if row.OfflineID != "" {
+		if offline, err := offlines.GetByID(row.OfflineID); err == nil {
+			m := &storeMatch{OfflineID: offline.OfflineID, Name: offline.Name}
+			if row.ShopName != "" && strings.TrimSpace(offline.Name) != strings.TrimSpace(row.ShopName) {
+				m.Mismatch = fmt.Sprintf("门店ID[%s]在有赞里是[%s]，和库存文件里的门店名称[%s]不一致", row.OfflineID, offline.Name, row.ShopName)
+			}
+			return m, nil
+		}
+		if row.ShopName == "" {
+			return nil, fmt.Errorf("有赞里没有门店ID[%s]", row.OfflineID)
+		}
+	}
+	m := &storeMatch{Name: row.ShopName}
+	offlineID, err := offlines.GetIDByName(row.ShopName)
+	if err != nil {
+		aliasID, ok := aliases.Lookup(row.ShopName)
+		if !ok {
+			return nil, fmt.Errorf("有赞里没有门店[%s]", row.ShopName+row.OfflineID)
+		}
+		offline, err := offlines.GetByID(aliasID)
+		if err != nil {
+			return nil, fmt.Errorf("门店[%s]的别名对应的门店ID[%s]在有赞里不存在", row.ShopName, aliasID)
+		}
+		offlineID, m.Name = offline.OfflineID, offline.Name
+	}
+	m.OfflineID = offlineID
+	if row.OfflineID != "" {
+		m.Mismatch = fmt.Sprintf("有赞里没有门店ID[%s]，按门店名称[%s]匹配到门店ID[%s]", row.OfflineID, row.ShopName, offlineID)
+	}
+	return m, nil
+}
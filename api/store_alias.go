@@ -0,0 +1,285 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+	"golang.org/x/text/width"
+)
+
+var ErrAliasNotFound = errors.New("Store alias not found")
+
+// StoreAlias 库存文件里的门店名称对应的有赞门店
+type StoreAlias struct {
+	Name      string    `json:"name"`
+	OfflineID string    `json:"offline_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AliasStore 保存门店别名，key 为 normalizeStoreName 之后的名称
+type AliasStore struct {
+	path    string
+	aliases map[string]*StoreAlias
+	sync.RWMutex
+}
+
+func NewAliasStore(dataDir string) (*AliasStore, error) {
+	s := &AliasStore{
+		path:    filepath.Join(dataDir, "store_aliases.json"),
+		aliases: make(map[string]*StoreAlias),
+	}
+	if err := readDataFile(s.path, &s.aliases); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// normalizeStoreName 全角转半角、去掉空白、统一小写，用于别名查找和模糊匹配
+func normalizeStoreName(name string) string {
+	name = width.Fold.String(name)
+	return strings.ToLower(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, name))
+}
+
+// Lookup 返回门店名称对应的有赞门店 ID
+func (s *AliasStore) Lookup(name string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	alias, ok := s.aliases[normalizeStoreName(name)]
+	if !ok {
+		return "", false
+	}
+	return alias.OfflineID, true
+}
+
+func (s *AliasStore) List() []*StoreAlias {
+	s.RLock()
+	aliases := make([]*StoreAlias, 0, len(s.aliases))
+	for _, alias := range s.aliases {
+		aliases = append(aliases, alias)
+	}
+	s.RUnlock()
+	sort.Slice(aliases, func(i, k int) bool {
+		return aliases[i].Name < aliases[k].Name
+	})
+	return aliases
+}
+
+// Save 先写入文件，写入成功后才替换内存里的别名
+func (s *AliasStore) Save(alias *StoreAlias) error {
+	s.Lock()
+	defer s.Unlock()
+	aliases := s.copyAliases()
+	aliases[normalizeStoreName(alias.Name)] = alias
+	if err := writeDataFile(s.path, aliases); err != nil {
+		return err
+	}
+	s.aliases = aliases
+	return nil
+}
+
+func (s *AliasStore) Delete(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	key := normalizeStoreName(name)
+	if _, ok := s.aliases[key]; !ok {
+		return ErrAliasNotFound
+	}
+	aliases := s.copyAliases()
+	delete(aliases, key)
+	if err := writeDataFile(s.path, aliases); err != nil {
+		return err
+	}
+	s.aliases = aliases
+	return nil
+}
+
+// copyAliases 调用方需要持有锁
+func (s *AliasStore) copyAliases() map[string]*StoreAlias {
+	aliases := make(map[string]*StoreAlias, len(s.aliases)+1)
+	for k, v := range s.aliases {
+		aliases[k] = v
+	}
+	return aliases
+}
+
+// storeSuggestion 一个可能对应的有赞门店，Score 越接近 1 越相似
+type storeSuggestion struct {
+	OfflineID string  `json:"offline_id"`
+	Name      string  `json:"name"`
+	Score     float64 `json:"score"`
+}
+
+// minSuggestionScore 低于这个相似度的门店不作为建议
+const minSuggestionScore = 0.5
+
+// suggestStores 按相似度返回最多 n 个可能的有赞门店
+func suggestStores(offlines *youzan.Offlines, name string, n int) []*storeSuggestion {
+	suggestions := make([]*storeSuggestion, 0)
+	a := []rune(normalizeStoreName(name))
+	if len(a) == 0 {
+		return suggestions
+	}
+	for _, offline := range offlines.Items {
+		b := []rune(normalizeStoreName(offline.Name))
+		if len(b) == 0 {
+			continue
+		}
+		if score := similarity(a, b); score >= minSuggestionScore {
+			suggestions = append(suggestions, &storeSuggestion{
+				OfflineID: offline.OfflineID,
+				Name:      offline.Name,
+				Score:     score,
+			})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, k int) bool {
+		return suggestions[i].Score > suggestions[k].Score
+	})
+	if len(suggestions) > n {
+		suggestions = suggestions[:n]
+	}
+	return suggestions
+}
+
+// similarity 综合编辑距离和最长公共子序列，"徐汇店" 和 "上海徐汇旗舰店" 这种缩写也能得到较高的分数
+func similarity(a, b []rune) float64 {
+	longer, shorter := len(a), len(b)
+	if shorter > longer {
+		longer, shorter = shorter, longer
+	}
+	byDistance := 1 - float64(levenshtein(a, b))/float64(longer)
+	// 缩写的每个字都按顺序出现在完整名称里，但长度差距越大越不可信
+	bySubsequence := float64(lcs(a, b)) / float64(shorter) * (0.6 + 0.4*float64(shorter)/float64(longer))
+	if bySubsequence > byDistance {
+		return bySubsequence
+	}
+	return byDistance
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for k := range prev {
+		prev[k] = k
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for k := 1; k <= len(b); k++ {
+			cost := 1
+			if a[i-1] == b[k-1] {
+				cost = 0
+			}
+			cur[k] = prev[k-1] + cost
+			if prev[k]+1 < cur[k] {
+				cur[k] = prev[k] + 1
+			}
+			if cur[k-1]+1 < cur[k] {
+				cur[k] = cur[k-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func lcs(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := 1; i <= len(a); i++ {
+		for k := 1; k <= len(b); k++ {
+			if a[i-1] == b[k-1] {
+				cur[k] = prev[k-1] + 1
+			} else if prev[k] > cur[k-1] {
+				cur[k] = prev[k]
+			} else {
+				cur[k] = cur[k-1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func (a *Api) ListStoreAliases(c *gin.Context) {
+	Resp(c, a.aliases.List())
+}
+
+// SaveStoreAlias 新建或覆盖一个门店别名，门店 ID 必须在有赞里存在
+func (a *Api) SaveStoreAlias(c *gin.Context) {
+	alias := &StoreAlias{}
+	if err := json.NewDecoder(c.Request.Body).Decode(alias); err != nil {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	if strings.TrimSpace(alias.Name) == "" || alias.OfflineID == "" {
+		RespErr(c, nil, "name 和 offline_id 不能为空")
+		return
+	}
+	offlines, err := a.youzan.QueryOfflines(c.Request.Context())
+	if err != nil {
+		RespErr(c, err, "查询有赞门店失败")
+		return
+	}
+	if _, err := offlines.GetByID(alias.OfflineID); err != nil {
+		RespErr(c, err, "有赞里没有门店ID["+alias.OfflineID+"]")
+		return
+	}
+	alias.CreatedAt = time.Now()
+	if err := a.aliases.Save(alias); err != nil {
+		RespErr(c, err, "保存门店别名失败")
+		return
+	}
+	Resp(c, alias)
+}
+
+func (a *Api) DeleteStoreAlias(c *gin.Context) {
+	if err := a.aliases.Delete(c.Param("name")); err != nil {
+		RespErr(c, err, "删除门店别名失败")
+		return
+	}
+	Resp(c, nil)
+}
+
+// StoreSuggestions 为没有匹配到有赞门店的名称给出建议
+// 传 name 时只查这个名称，传 job_id 时查 job 里所有匹配不到的门店名称
+func (a *Api) StoreSuggestions(c *gin.Context) {
+	names := make([]string, 0)
+	if name := c.Query("name"); name != "" {
+		names = append(names, name)
+	}
+	if jobID := c.Query("job_id"); jobID != "" {
+		job, err := a.jobs.Get(jobID)
+		if err != nil {
+			RespErr(c, err, "任务不存在")
+			return
+		}
+		names = append(names, job.ShopNames()...)
+	}
+	offlines, err := a.youzan.QueryOfflines(c.Request.Context())
+	if err != nil {
+		RespErr(c, err, "查询有赞门店失败")
+		return
+	}
+	results := make(map[string][]*storeSuggestion)
+	for _, name := range names {
+		row := &ExcelRow{ShopName: name}
+		if _, err := matchStore(offlines, a.aliases, row); err == nil {
+			continue
+		}
+		results[name] = suggestStores(offlines, name, 3)
+	}
+	Resp(c, results)
+}
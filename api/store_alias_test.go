@@ -0,0 +1,150 @@
+package api
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+func TestNormalizeStoreName(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: "徐汇店", want: "徐汇店"},
+		{in: " 徐汇 店 ", want: "徐汇店"},
+		{in: "徐汇　店", want: "徐汇店"},
+		{in: "ＡＢＣ１号店", want: "abc1号店"},
+		{in: "Shop\tA", want: "shopa"},
+		{in: "（徐汇）店", want: "(徐汇)店"},
+		{in: "", want: ""},
+	}
+	for _, c := range cases {
+		if got := normalizeStoreName(c.in); got != c.want {
+			t.Errorf("normalizeStoreName(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestAliasStore(t *testing.T) {
+	s, cleanup := testAliasStore(t, map[string]string{"ＡＢＣ店": "101"})
+	defer cleanup()
+	if id, ok := s.Lookup(" abc店"); !ok || id != "101" {
+		t.Errorf("Lookup = %q, %v, want 101, true", id, ok)
+	}
+	if _, ok := s.Lookup("徐汇店"); ok {
+		t.Error("Lookup of unknown name found an alias")
+	}
+
+	// 重新读取文件，别名应该还在
+	reloaded, err := NewAliasStore(filepath.Dir(s.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := reloaded.Lookup("abc店"); !ok || id != "101" {
+		t.Errorf("Lookup after reload = %q, %v, want 101, true", id, ok)
+	}
+
+	if err := s.Delete("ABC店"); err != nil {
+		t.Errorf("Delete error: %v", err)
+	}
+	if err := s.Delete("ABC店"); err != ErrAliasNotFound {
+		t.Errorf("Delete twice error = %v, want %v", err, ErrAliasNotFound)
+	}
+	if n := len(s.List()); n != 0 {
+		t.Errorf("List after Delete = %d aliases, want 0", n)
+	}
+}
+
+func TestSuggestStores(t *testing.T) {
+	offlines := &youzan.Offlines{Items: []*youzan.Offline{
+		{OfflineID: "101", Name: "上海徐汇旗舰店"},
+		{OfflineID: "102", Name: "上海静安店"},
+		{OfflineID: "103", Name: "徐汇店"},
+		{OfflineID: "104", Name: ""},
+	}}
+	cases := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{name: "徐汇 店", n: 3, want: []string{"103", "101"}},
+		{name: "徐汇店", n: 1, want: []string{"103"}},
+		{name: "静安", n: 3, want: []string{"102"}},
+		{name: "北京朝阳", n: 3, want: []string{}},
+		{name: " ", n: 3, want: []string{}},
+	}
+	for _, c := range cases {
+		ids := make([]string, 0)
+		for _, s := range suggestStores(offlines, c.name, c.n) {
+			if s.Score < minSuggestionScore || s.Score > 1 {
+				t.Errorf("suggestStores(%q) %s score %f out of range", c.name, s.OfflineID, s.Score)
+			}
+			ids = append(ids, s.OfflineID)
+		}
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("suggestStores(%q, %d) = %v, want %v", c.name, c.n, ids, c.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	cases := []struct {
+		a, b string
+		min  float64
+		max  float64
+	}{
+		{a: "徐汇店", b: "徐汇店", min: 1, max: 1},
+		{a: "徐汇店", b: "上海徐汇旗舰店", min: 0.5, max: 0.99},
+		{a: "徐汇店", b: "静安店", min: 0.3, max: 0.34},
+		{a: "abc", b: "xyz", min: 0, max: 0},
+	}
+	for _, c := range cases {
+		got := similarity([]rune(c.a), []rune(c.b))
+		if got < c.min || got > c.max {
+			t.Errorf("similarity(%q, %q) = %f, want in [%f, %f]", c.a, c.b, got, c.min, c.max)
+		}
+		if back := similarity([]rune(c.b), []rune(c.a)); back != got {
+			t.Errorf("similarity(%q, %q) = %f, not symmetric with %f", c.b, c.a, back, got)
+		}
+	}
+}
+
+func TestMatchStore(t *testing.T) {
+	aliases, cleanup := testAliasStore(t, map[string]string{"徐汇": "101", "旧店": "999"})
+	defer cleanup()
+	cases := []struct {
+		row      *ExcelRow
+		want     string
+		mismatch bool
+		err      bool
+	}{
+		{row: &ExcelRow{OfflineID: "101"}, want: "101"},
+		{row: &ExcelRow{OfflineID: "101", ShopName: "徐汇店"}, want: "101"},
+		{row: &ExcelRow{OfflineID: "101", ShopName: "静安店"}, want: "101", mismatch: true},
+		{row: &ExcelRow{OfflineID: "999", ShopName: "静安店"}, want: "102", mismatch: true},
+		{row: &ExcelRow{OfflineID: "999"}, err: true},
+		{row: &ExcelRow{ShopName: " 静安店 "}, want: "102"},
+		{row: &ExcelRow{ShopName: "徐 汇"}, want: "101"},
+		{row: &ExcelRow{ShopName: "旧店"}, err: true},
+		{row: &ExcelRow{ShopName: "北京店"}, err: true},
+	}
+	for _, c := range cases {
+		m, err := matchStore(testOfflines(), aliases, c.row)
+		if c.err {
+			if err == nil {
+				t.Errorf("matchStore(%+v) = %+v, want error", c.row, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("matchStore(%+v) error: %v", c.row, err)
+			continue
+		}
+		if m.OfflineID != c.want || (m.Mismatch != "") != c.mismatch {
+			t.Errorf("matchStore(%+v) = %+v, want %s, mismatch %v", c.row, m, c.want, c.mismatch)
+		}
+	}
+}
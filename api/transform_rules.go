@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuyuntech/inventory_sync_go/money"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+// TransformMatch 规则适用的范围，同时设置多个条件时都要满足，都不设置时适用于所有商品
+type TransformMatch struct {
+	// Stores 门店 ID 或门店名称
+	Stores []string `json:"stores,omitempty"`
+	// ItemPrefixes 商品编码前缀
+	ItemPrefixes []string `json:"item_prefixes,omitempty"`
+	// Tags 有赞商品分组名称或分组 ID
+	Tags []string `json:"tags,omitempty"`
+}
+
+func (m *TransformMatch) match(offlineID, offlineName string, item *youzan.Item) bool {
+	if len(m.Stores) > 0 && !containsString(m.Stores, offlineID) && !containsString(m.Stores, offlineName) {
+		return false
+	}
+	if len(m.ItemPrefixes) > 0 {
+		found := false
+		for _, prefix := range m.ItemPrefixes {
+			if strings.HasPrefix(item.ItemNO, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(m.Tags) > 0 {
+		found := false
+		for _, tag := range m.Tags {
+			if item.HasTag(tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// TransformRule 把库存文件里的库存和价格转换为发布到有赞的值
+// 库存依次扣除 Buffer、按 Percent 分配、限制在 Min 和 Max 之间，最后不小于 0
+type TransformRule struct {
+	Name  string          `json:"name"`
+	Match *TransformMatch `json:"match"`
+	// Buffer 安全库存，不在线上售卖的数量
+	Buffer money.Stock `json:"buffer"`
+	// Percent 扣除安全库存之后分配到线上的百分比，0 表示 100%，结果向下取整
+	Percent float64 `json:"percent"`
+	// Min、Max 发布库存的下限和上限，为空时不限制
+	Min *money.Stock `json:"min,omitempty"`
+	Max *money.Stock `json:"max,omitempty"`
+	// PricePercent 发布价格为库存文件价格的百分比，0 表示不调整，结果四舍五入到分
+	PricePercent float64 `json:"price_percent"`
+}
+
+// Quantity 计算发布到有赞的库存
+func (r *TransformRule) Quantity(raw money.Stock) money.Stock {
+	q := raw - r.Buffer
+	if r.Percent > 0 {
+		q = money.Stock(math.Floor(float64(q) * r.Percent / 100))
+	}
+	if r.Min != nil && q < *r.Min {
+		q = *r.Min
+	}
+	if r.Max != nil && q > *r.Max {
+		q = *r.Max
+	}
+	if q < 0 {
+		q = 0
+	}
+	return q
+}
+
+// Price 计算发布到有赞的价格
+func (r *TransformRule) Price(raw money.Money) money.Money {
+	if r.PricePercent <= 0 {
+		return raw
+	}
+	return money.Money(math.Round(float64(raw) * r.PricePercent / 100))
+}
+
+// Apply 返回转换后的行，原始行不变
+func (r *TransformRule) Apply(row *ExcelRow) *ExcelRow {
+	published := *row
+	published.Quantity = r.Quantity(row.Quantity)
+	published.Price = r.Price(row.Price)
+	return &published
+}
+
+// TransformRules 按顺序匹配，使用第一条匹配的规则
+type TransformRules []*TransformRule
+
+// For 返回门店商品使用的规则，没有匹配时返回 nil
+func (rs TransformRules) For(offlineID, offlineName string, item *youzan.Item) *TransformRule {
+	for _, r := range rs {
+		if r.Match == nil || r.Match.match(offlineID, offlineName, item) {
+			return r
+		}
+	}
+	return nil
+}
+
+// TransformRuleStore 保存库存转换规则，修改后写入 dataDir 下的 json 文件
+type TransformRuleStore struct {
+	path  string
+	rules TransformRules
+	sync.RWMutex
+}
+
+func NewTransformRuleStore(dataDir string) (*TransformRuleStore, error) {
+	s := &TransformRuleStore{
+		path:  filepath.Join(dataDir, "transform_rules.json"),
+		rules: make(TransformRules, 0),
+	}
+	if err := readDataFile(s.path, &s.rules); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get 返回当前规则，保存新规则时整体替换，分析过程中使用的规则不会被修改
+func (s *TransformRuleStore) Get() TransformRules {
+	s.RLock()
+	defer s.RUnlock()
+	return s.rules
+}
+
+func (s *TransformRuleStore) Save(rules TransformRules) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := writeDataFile(s.path, rules); err != nil {
+		return err
+	}
+	s.rules = rules
+	return nil
+}
+
+func (a *Api) GetTransformRules(c *gin.Context) {
+	Resp(c, a.transformRules.Get())
+}
+
+// SaveTransformRules 替换全部库存转换规则
+func (a *Api) SaveTransformRules(c *gin.Context) {
+	rules := make(TransformRules, 0)
+	if err := json.NewDecoder(c.Request.Body).Decode(&rules); err != nil {
+		RespErr(c, err, "参数格式不正确")
+		return
+	}
+	for _, r := range rules {
+		if r == nil || r.Name == "" {
+			RespErr(c, nil, "规则名称不能为空")
+			return
+		}
+		if r.Percent < 0 || r.Percent > 100 {
+			RespErr(c, nil, "规则["+r.Name+"]的 percent 必须在 0 到 100 之间")
+			return
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			RespErr(c, nil, "规则["+r.Name+"]的 min 大于 max")
+			return
+		}
+	}
+	if err := a.transformRules.Save(rules); err != nil {
+		RespErr(c, err, "保存库存转换规则失败")
+		return
+	}
+	Resp(c, rules)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/xuyuntech/inventory_sync_go/money"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+func stockPtr(s money.Stock) *money.Stock {
+	return &s
+}
+
+func TestTransformRuleQuantity(t *testing.T) {
+	cases := []struct {
+		name string
+		rule *TransformRule
+		raw  money.Stock
+		want money.Stock
+	}{
+		{name: "no change", rule: &TransformRule{}, raw: 10, want: 10},
+		{name: "buffer", rule: &TransformRule{Buffer: 3}, raw: 10, want: 7},
+		{name: "buffer above stock", rule: &TransformRule{Buffer: 3}, raw: 2, want: 0},
+		{name: "percent rounds down", rule: &TransformRule{Percent: 50}, raw: 7, want: 3},
+		{name: "buffer then percent", rule: &TransformRule{Buffer: 2, Percent: 50}, raw: 12, want: 5},
+		{name: "min", rule: &TransformRule{Buffer: 5, Min: stockPtr(1)}, raw: 3, want: 1},
+		{name: "max", rule: &TransformRule{Max: stockPtr(20)}, raw: 100, want: 20},
+		{name: "negative raw", rule: &TransformRule{}, raw: -5, want: 0},
+		{name: "negative min", rule: &TransformRule{Min: stockPtr(-3)}, raw: -5, want: 0},
+	}
+	for _, c := range cases {
+		if got := c.rule.Quantity(c.raw); got != c.want {
+			t.Errorf("%s: Quantity(%d) = %d, want %d", c.name, c.raw, got, c.want)
+		}
+	}
+}
+
+func TestTransformRulePrice(t *testing.T) {
+	cases := []struct {
+		percent float64
+		raw     money.Money
+		want    money.Money
+	}{
+		{percent: 0, raw: 999, want: 999},
+		{percent: 100, raw: 999, want: 999},
+		{percent: 110, raw: 1000, want: 1100},
+		{percent: 95, raw: 999, want: 949},
+		{percent: 50, raw: 101, want: 51},
+	}
+	for _, c := range cases {
+		r := &TransformRule{PricePercent: c.percent}
+		if got := r.Price(c.raw); got != c.want {
+			t.Errorf("Price(%d) with %v%% = %d, want %d", c.raw, c.percent, got, c.want)
+		}
+	}
+}
+
+func TestTransformRuleApply(t *testing.T) {
+	r := &TransformRule{Buffer: 2, PricePercent: 200}
+	row := &ExcelRow{ItemNO: "A1", Quantity: 10, Price: 100}
+	published := r.Apply(row)
+	if published.Quantity != 8 || published.Price != 200 || published.ItemNO != "A1" {
+		t.Errorf("Apply = %+v", published)
+	}
+	if row.Quantity != 10 || row.Price != 100 {
+		t.Errorf("Apply changed the original row: %+v", row)
+	}
+}
+
+func TestTransformRulesFor(t *testing.T) {
+	item := &youzan.Item{ItemNO: "FOOD-001", Tags: []*youzan.ItemTag{{ID: 7, Name: "生鲜"}}}
+	cases := []struct {
+		name  string
+		rules TransformRules
+		id    string
+		store string
+		want  string
+	}{
+		{
+			name:  "first match wins",
+			rules: TransformRules{{Name: "a"}, {Name: "b"}},
+			want:  "a",
+		},
+		{
+			name: "store by id or name",
+			rules: TransformRules{
+				{Name: "other", Match: &TransformMatch{Stores: []string{"102"}}},
+				{Name: "xuhui", Match: &TransformMatch{Stores: []string{"徐汇店"}}},
+			},
+			id: "101", store: "徐汇店",
+			want: "xuhui",
+		},
+		{
+			name: "prefix",
+			rules: TransformRules{
+				{Name: "drink", Match: &TransformMatch{ItemPrefixes: []string{"DRINK-"}}},
+				{Name: "food", Match: &TransformMatch{ItemPrefixes: []string{"DRINK-", "FOOD-"}}},
+			},
+			want: "food",
+		},
+		{
+			name: "tag by name or id",
+			rules: TransformRules{
+				{Name: "by name", Match: &TransformMatch{Tags: []string{"冷冻"}}},
+				{Name: "by id", Match: &TransformMatch{Tags: []string{"7"}}},
+			},
+			want: "by id",
+		},
+		{
+			name: "all conditions",
+			rules: TransformRules{
+				{Name: "partial", Match: &TransformMatch{Stores: []string{"101"}, Tags: []string{"冷冻"}}},
+				{Name: "all", Match: &TransformMatch{Stores: []string{"101"}, ItemPrefixes: []string{"FOOD-"}, Tags: []string{"生鲜"}}},
+			},
+			id:   "101",
+			want: "all",
+		},
+		{
+			name:  "none",
+			rules: TransformRules{{Name: "other", Match: &TransformMatch{Stores: []string{"102"}}}},
+			id:    "101",
+		},
+	}
+	for _, c := range cases {
+		got := c.rules.For(c.id, c.store, item)
+		name := ""
+		if got != nil {
+			name = got.Name
+		}
+		if name != c.want {
+			t.Errorf("%s: For = %q, want %q", c.name, name, c.want)
+		}
+	}
+}
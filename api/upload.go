@@ -1,27 +1,41 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"mime/multipart"
 	"strconv"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
-	"github.com/tealeg/xlsx"
+	"github.com/xuyuntech/inventory_sync_go/money"
+	"github.com/xuyuntech/inventory_sync_go/reader"
 	"github.com/xuyuntech/inventory_sync_go/youzan"
 )
 
+// goodUpdatedSku 需要更新的 sku，有多个规格时 K、V 为用 "/" 连接的规格名称和值
 type goodUpdatedSku struct {
-	K          string  `json:"k"`
-	V          string  `json:"v"`
-	Price      float64 `json:"price"`
-	Quantity   float64 `json:"quantity"`
-	ToPrice    float64 `json:"to_price"`
-	ToQuantity float64 `json:"to_quantity"`
-	ID         int64   `json:"id"`
+	K          string      `json:"k"`
+	V          string      `json:"v"`
+	Price      money.Money `json:"price"`
+	Quantity   money.Stock `json:"quantity"`
+	ToPrice    money.Money `json:"to_price"`
+	ToQuantity money.Stock `json:"to_quantity"`
+	ID         int64       `json:"id"`
+	OuterID    string      `json:"outer_id"`
+	// Changed 按对比规则需要同步的字段，不同步的字段 To 值和有赞当前值相同
+	Changed []string `json:"changed"`
+	// RawPrice、RawQuantity 库存文件里的原始值，To 值为经过转换规则之后发布到有赞的值
+	RawPrice    money.Money `json:"raw_price"`
+	RawQuantity money.Stock `json:"raw_quantity"`
+	// NeedsApproval 触发了检查规则，审批之后才能写回，Violations 为触发的规则
+	NeedsApproval bool     `json:"needs_approval"`
+	Violations    []string `json:"violations,omitempty"`
+	// Name 规格组合的展示形式，例如 "颜色:红 尺码:XL"
+	Name       string                    `json:"name"`
+	Properties []*youzan.GoodSkuProperty `json:"properties"`
 }
 type goodUpdated struct {
 	OfflineID   int64             `json:"offline_id"`
@@ -30,63 +44,151 @@ type goodUpdated struct {
 	ItemTitle   string            `json:"item_title"`
 	ItemNo      string            `json:"item_no"`
 	Skus        []*goodUpdatedSku `json:"skus"`
+	// Rule 判断这个门店商品需要更新时使用的对比规则
+	Rule string `json:"rule"`
+	// Transform 计算发布库存和价格时使用的转换规则，没有时为空
+	Transform string `json:"transform,omitempty"`
 }
 
+// 多个 sheet 的处理方式
+const (
+	// SheetModeSingle 只允许一个 sheet，门店从门店列读取
+	SheetModeSingle = "single"
+	// SheetModeStore 每个 sheet 是一个门店，sheet 名称为门店名称或门店 ID
+	SheetModeStore = "store"
+)
+
+// Upload 上传库存文件，按表头识别列，可以通过 profile 参数选择保存的列映射
+// 支持 multipart 上传 xlsx/xls/csv/json 文件，也可以直接把 json、ndjson 或 csv 作为请求体
 func (a *Api) Upload(c *gin.Context) {
 	var (
-		err        error
-		file       *multipart.FileHeader
-		fileReader multipart.File
-		excelFile  *xlsx.File
-		bs         []byte
-		itemsHash  map[string][]*ExcelRow
+		err       error
+		fileName  string
+		tables    []*reader.Table
+		profile   *ColumnProfile
+		sheetMode = uploadParam(c, "sheet_mode")
+		maxErrors = -1
 	)
-	file, err = c.FormFile("file")
-	if err != nil {
-		RespErr(c, err)
+	if sheetMode == "" {
+		sheetMode = SheetModeSingle
+	}
+	if sheetMode != SheetModeSingle && sheetMode != SheetModeStore {
+		RespErr(c, nil, "未知的 sheet_mode: "+sheetMode)
 		return
 	}
-	fileReader, err = file.Open()
+	if v := uploadParam(c, "max_errors"); v != "" {
+		maxErrors, err = strconv.Atoi(v)
+		if err != nil {
+			RespErr(c, err, "max_errors 必须是整数")
+			return
+		}
+	}
+	if name := uploadParam(c, "profile"); name != "" {
+		profile, err = a.profiles.Get(name)
+		if err != nil {
+			RespErr(c, err, "列映射不存在")
+			return
+		}
+	}
+	fileName, tables, err = readUploadedFile(c)
 	if err != nil {
-		RespErr(c, err)
+		RespErr(c, err, err.Error())
 		return
 	}
-	bs, err = ioutil.ReadAll(fileReader)
-	if err != nil {
-		RespErr(c, err)
+	validator := newRowValidator(a.queryOfflinesForUpload(c.Request.Context()), a.aliases)
+	switch sheetMode {
+	case SheetModeSingle:
+		if len(tables) != 1 {
+			RespErr(c, errors.New("excel 文件 sheet 大于 1, 请确保上传的是库存文件或者使用 sheet_mode=store"))
+			return
+		}
+		if sr := validator.AddSheet(tables[0], profile, nil); sr.Skipped {
+			RespErrData(c, nil, sr.Reason, validator.report)
+			return
+		}
+	case SheetModeStore:
+		consumed := 0
+		for _, table := range tables {
+			if sr := validator.AddSheet(table, profile, validator.sheetStore(table.Name)); !sr.Skipped {
+				consumed++
+			}
+		}
+		if consumed == 0 {
+			RespErrData(c, nil, "没有可以读取的 sheet", validator.report)
+			return
+		}
+	}
+	report := validator.report
+	if maxErrors >= 0 && len(report.Errors) > maxErrors {
+		RespErrData(c, nil, fmt.Sprintf("库存文件有 %d 处错误，超过了 %d 处", len(report.Errors), maxErrors), report)
 		return
 	}
-	excelFile, err = xlsx.OpenBinary(bs)
+	job := a.jobs.Create(fileName, validator.itemsHash, validator.skuRows, report)
+	Resp(c, map[string]interface{}{
+		"job":    job.Summary(),
+		"report": report,
+	})
+}
+
+// queryOfflinesForUpload 查询门店列表用于校验，查询失败时不校验门店
+func (a *Api) queryOfflinesForUpload(ctx context.Context) *youzan.Offlines {
+	offlines, err := a.youzan.QueryOfflines(ctx)
 	if err != nil {
-		RespErr(c, err)
-		return
+		logrus.Warnf("查询门店失败，跳过门店校验: %v", err)
+		return nil
 	}
-	if len(excelFile.Sheets) != 1 {
-		RespErr(c, errors.New("excel 文件 sheet 大于 1, 请确保上传的是库存文件"))
-		return
+	return offlines
+}
+
+// uploadParam 读取表单参数，请求体不是表单时从 query 读取
+func uploadParam(c *gin.Context, key string) string {
+	if v := c.PostForm(key); v != "" {
+		return v
 	}
-	itemsHash = make(map[string][]*ExcelRow)
-	sheet := excelFile.Sheets[0]
-	for _, row := range sheet.Rows[1:] {
-		excelRow := &ExcelRow{}
-		if err := row.ReadStruct(excelRow); err != nil {
-			vals := make([]string, 0)
-			for _, cell := range row.Cells {
-				vals = append(vals, cell.Value)
-			}
-			logrus.Errorf("parse excel row err: (%v), vals: %+v", err, vals)
+	return c.Query(key)
+}
+
+// readUploadedFile 读取 multipart 的 file 字段，请求体不是 multipart 时把整个请求体当作文件
+func readUploadedFile(c *gin.Context) (string, []*reader.Table, error) {
+	var (
+		fileName    string
+		contentType = c.ContentType()
+		bs          []byte
+		err         error
+	)
+	if contentType == gin.MIMEMultipartPOSTForm {
+		file, err := c.FormFile("file")
+		if err != nil {
+			return "", nil, err
+		}
+		f, err := file.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		defer f.Close()
+		if bs, err = ioutil.ReadAll(f); err != nil {
+			return "", nil, err
+		}
+		fileName = file.Filename
+		contentType = file.Header.Get("Content-Type")
+	} else {
+		if bs, err = ioutil.ReadAll(c.Request.Body); err != nil {
+			return "", nil, err
 		}
-		if _, ok := itemsHash[excelRow.ItemNO]; !ok {
-			itemsHash[excelRow.ItemNO] = make([]*ExcelRow, 0)
+		fileName = c.Query("file_name")
+		if fileName == "" {
+			fileName = "upload"
 		}
-		itemsHash[excelRow.ItemNO] = append(itemsHash[excelRow.ItemNO], excelRow)
 	}
-	InventorySyncTaskCache = &InventorySyncTask{
-		Status:    "init",
-		ItemsHash: itemsHash,
+	r, err := reader.ForFile(fileName, contentType, bs)
+	if err != nil {
+		return "", nil, err
 	}
-	Resp(c, nil)
-
+	tables, err := r.Read(bs)
+	if err != nil {
+		return "", nil, err
+	}
+	return fileName, tables, nil
 }
 
 type goodsDetailResponse struct {
@@ -95,44 +197,44 @@ type goodsDetailResponse struct {
 	} `json:"response"`
 }
 
-func parseGoodsDetail(b []byte) *youzan.GoodsDetail {
+// skuParseError 有赞返回的 sku 价格或库存无法解析
+type skuParseError struct {
+	Sku *youzan.GoodsSku
+	Msg string
+}
+
+// parseGoodsDetail 解析门店商品详情，价格或库存无法解析的 sku 从 Skus 里去掉，单独返回
+func parseGoodsDetail(b []byte) (*youzan.GoodsDetail, []*skuParseError, error) {
+	if ye := youzan.DecodeError(b); ye != nil {
+		return nil, nil, ye
+	}
 	gdr := &goodsDetailResponse{}
 	if err := json.Unmarshal(b, gdr); err != nil {
-		logrus.Errorf("转换 GoodsDetail 出错(%v), b: (%s)", err, string(b))
-		return nil
+		return nil, nil, fmt.Errorf("转换 GoodsDetail 出错(%v), b: (%s)", err, string(b))
 	}
 	// 格式化 sku
 	detail := gdr.Response.Item
 	if detail == nil {
-		return nil
+		return nil, nil, errors.New("有赞没有返回商品详情")
 	}
 	var err error
+	skus := make([]*youzan.GoodsSku, 0, len(detail.Skus))
+	invalid := make([]*skuParseError, 0)
 	for _, sku := range detail.Skus {
-		sku.Price, err = strconv.ParseFloat(sku.PriceStr, 64)
+		sku.Price, err = money.ParseMoney(sku.PriceStr)
 		if err != nil {
-			logrus.Errorf("商品 [%s] sku 价格转换错误: %f", sku.Price)
+			logrus.Errorf("商品 [%s] sku 价格转换错误: %s", detail.Title, sku.PriceStr)
+			invalid = append(invalid, &skuParseError{Sku: sku, Msg: fmt.Sprintf("有赞 sku 价格[%s]无法解析: %v", sku.PriceStr, err)})
 			continue
 		}
-		sku.Quantity, err = strconv.ParseFloat(sku.QuantityStr, 64)
+		sku.Quantity, err = money.ParseStock(sku.QuantityStr)
 		if err != nil {
-			logrus.Errorf("商品 [%s] sku 库存转换错误: %f", sku.Quantity)
+			logrus.Errorf("商品 [%s] sku 库存转换错误: %s", detail.Title, sku.QuantityStr)
+			invalid = append(invalid, &skuParseError{Sku: sku, Msg: fmt.Sprintf("有赞 sku 库存[%s]无法解析: %v", sku.QuantityStr, err)})
 			continue
 		}
+		skus = append(skus, sku)
 	}
-	return detail
-}
-
-func needYouzanGoodToBeUpdated(excelRow *ExcelRow, gd *youzan.GoodsDetail) (bool, error) {
-	if len(gd.Skus) <= 0 {
-		return false, fmt.Errorf("有赞商品 [%s] 没有设置 sku", gd.Title)
-	}
-	sku := gd.Skus[0]
-	if sku.OuterID != gd.OuterID {
-		return false, fmt.Errorf("有赞商品 [%s] 第一个 sku 的商品编码设置不正确", gd.Title)
-	}
-
-	if sku.Price != excelRow.Price || sku.Quantity != excelRow.Quantity {
-		return true, nil
-	}
-	return false, nil
+	detail.Skus = skus
+	return detail, invalid, nil
 }
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xuyuntech/inventory_sync_go/reader"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+// rowError 库存文件中一个单元格的问题，Row 从 1 开始，和 excel 里看到的行号一致
+type rowError struct {
+	Sheet  string `json:"sheet"`
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Value  string `json:"value,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (e *rowError) Error() string {
+	return fmt.Sprintf("%s 第 %d 行 %s: %s", e.Sheet, e.Row, e.Column, e.Reason)
+}
+
+// uploadReport 上传时的校验结果，有问题的行不会进入分析
+type uploadReport struct {
+	Rows       int         `json:"rows"`
+	Accepted   int         `json:"accepted"`
+	Duplicated int         `json:"duplicated"`
+	Errors     []*rowError `json:"errors"`
+	// Sheets 每个 sheet 的读取情况
+	Sheets []*sheetReport `json:"sheets"`
+	// StoresChecked 是否和有赞的门店列表核对过，查询门店失败时跳过
+	StoresChecked bool `json:"stores_checked"`
+}
+
+// sheetReport 一个 sheet 是否被读取，按 sheet 区分门店时 Store 为 sheet 对应的门店
+type sheetReport struct {
+	Name     string `json:"name"`
+	Store    string `json:"store,omitempty"`
+	Rows     int    `json:"rows"`
+	Accepted int    `json:"accepted"`
+	Skipped  bool   `json:"skipped"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// rowValidator 逐行校验并收集 ExcelRow
+type rowValidator struct {
+	offlines *youzan.Offlines
+	aliases  *AliasStore
+	report   *uploadReport
+	// seen 商品编码 + 门店第一次出现的行
+	seen      map[string]*seenRow
+	itemsHash map[string][]*ExcelRow
+	// skuRows 没有商品编码的行，key 为 sku 编码
+	skuRows map[string][]*ExcelRow
+}
+
+type seenRow struct {
+	row   *ExcelRow
+	rowNo int
+}
+
+func newRowValidator(offlines *youzan.Offlines, aliases *AliasStore) *rowValidator {
+	return &rowValidator{
+		offlines: offlines,
+		aliases:  aliases,
+		report: &uploadReport{
+			Errors:        make([]*rowError, 0),
+			Sheets:        make([]*sheetReport, 0),
+			StoresChecked: offlines != nil,
+		},
+		seen:      make(map[string]*seenRow),
+		itemsHash: make(map[string][]*ExcelRow),
+		skuRows:   make(map[string][]*ExcelRow),
+	}
+}
+
+// Add 校验一行，没有问题时加入 itemsHash，没有商品编码的行加入 skuRows
+func (v *rowValidator) Add(sheet string, rowNo int, mapping *columnMapping, cells []string) {
+	if isBlank(cells) {
+		return
+	}
+	v.report.Rows++
+	row, errs := mapping.ParseRow(cells)
+	store := ""
+	if len(errs) == 0 {
+		var ok bool
+		if store, ok = v.storeKey(row); !ok {
+			errs = append(errs, &rowError{Column: ColumnShopName, Value: row.ShopName + row.OfflineID, Reason: "有赞里没有这个门店"})
+		}
+	}
+	if len(errs) == 0 {
+		key := row.ItemNO + "\x00" + row.SkuNO + "\x00" + row.propertyKey() + "\x00" + store
+		if first, ok := v.seen[key]; ok {
+			if first.row.Quantity == row.Quantity && first.row.Price == row.Price && first.row.NoPrice == row.NoPrice {
+				v.report.Duplicated++
+				return
+			}
+			column, value := ColumnItemNO, row.ItemNO
+			if value == "" {
+				column, value = ColumnSkuNO, row.SkuNO
+			}
+			errs = append(errs, &rowError{
+				Column: column,
+				Value:  value,
+				Reason: fmt.Sprintf("和第 %d 行是同一个商品(sku)和门店，但库存或价格不同", first.rowNo),
+			})
+		} else {
+			v.seen[key] = &seenRow{row: row, rowNo: rowNo}
+		}
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			e.Sheet = sheet
+			e.Row = rowNo
+		}
+		v.report.Errors = append(v.report.Errors, errs...)
+		return
+	}
+	v.report.Accepted++
+	if row.ItemNO == "" {
+		v.skuRows[row.SkuNO] = append(v.skuRows[row.SkuNO], row)
+		return
+	}
+	v.itemsHash[row.ItemNO] = append(v.itemsHash[row.ItemNO], row)
+}
+
+// AddSheet 校验一个 sheet 的所有行，表头不符合要求时跳过整个 sheet
+func (v *rowValidator) AddSheet(table *reader.Table, profile *ColumnProfile, defaults map[string]string) *sheetReport {
+	sr := &sheetReport{
+		Name:  table.Name,
+		Store: defaults[ColumnShopName] + defaults[ColumnOfflineID],
+	}
+	v.report.Sheets = append(v.report.Sheets, sr)
+	if len(table.Rows) == 0 {
+		sr.Skipped = true
+		sr.Reason = "sheet 为空"
+		return sr
+	}
+	mapping, err := newColumnMapping(table.Rows[0], profile, defaults)
+	if err != nil {
+		sr.Skipped = true
+		sr.Reason = err.Error()
+		return sr
+	}
+	rows, accepted := v.report.Rows, v.report.Accepted
+	for i, cells := range table.Rows[1:] {
+		v.Add(table.Name, i+2, mapping, cells)
+	}
+	sr.Rows = v.report.Rows - rows
+	sr.Accepted = v.report.Accepted - accepted
+	return sr
+}
+
+// sheetStore 按 sheet 区分门店时，sheet 名称是有赞门店 ID 的当作 offline_id，否则当作门店名称
+func (v *rowValidator) sheetStore(name string) map[string]string {
+	name = strings.TrimSpace(name)
+	if v.offlines != nil {
+		for _, o := range v.offlines.Items {
+			if o.OfflineID == name {
+				return map[string]string{ColumnOfflineID: name}
+			}
+		}
+	}
+	return map[string]string{ColumnShopName: name}
+}
+
+// storeKey 判断重复行时使用的门店，查询到门店列表时为匹配到的门店 ID，找不到门店时返回 false
+func (v *rowValidator) storeKey(row *ExcelRow) (string, bool) {
+	if v.offlines == nil {
+		return row.OfflineID + "\x00" + row.ShopName, true
+	}
+	m, err := matchStore(v.offlines, v.aliases, row)
+	if err != nil {
+		return "", false
+	}
+	return m.OfflineID, true
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/xuyuntech/inventory_sync_go/reader"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+func testOfflines() *youzan.Offlines {
+	return &youzan.Offlines{Items: []*youzan.Offline{
+		{OfflineID: "101", Name: "徐汇店"},
+		{OfflineID: "102", Name: "静安店"},
+	}}
+}
+
+// testAliasStore 在临时目录里创建门店别名，调用方用返回的函数删除临时目录
+func testAliasStore(t *testing.T, aliases map[string]string) (*AliasStore, func()) {
+	dir, err := ioutil.TempDir("", "aliases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	s, err := NewAliasStore(dir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for name, id := range aliases {
+		if err := s.Save(&StoreAlias{Name: name, OfflineID: id}); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	return s, cleanup
+}
+
+func TestRowValidator(t *testing.T) {
+	table := &reader.Table{
+		Name: "Sheet1",
+		Rows: [][]string{
+			{"商品编码", "门店ID", "门店", "库存", "价格"},
+			{"A1", "", "徐汇店", "10", "1"},
+			{"A1", "101", "", "10", "1"},
+			{"A1", "", "徐汇 ", "10", "1"},
+			{"A1", "", "徐汇店", "11", "1"},
+			{"A1", "", "静安店", "5", "1"},
+			{"A2", "", "不存在店", "1", "1"},
+			{"", "", "", "", ""},
+			{"", "", "徐汇店", "1", "1"},
+		},
+	}
+	cases := []struct {
+		name       string
+		offlines   *youzan.Offlines
+		accepted   int
+		duplicated int
+		itemRows   int
+		errRows    []int
+	}{
+		{
+			name:       "with store list",
+			offlines:   testOfflines(),
+			accepted:   2,
+			duplicated: 2,
+			itemRows:   2,
+			errRows:    []int{5, 7, 9},
+		},
+		{
+			// 没有门店列表时只能按单元格判断重复，门店 ID 和门店名称不同的行都当作不同门店
+			name:       "without store list",
+			offlines:   nil,
+			accepted:   5,
+			duplicated: 0,
+			itemRows:   4,
+			errRows:    []int{5, 9},
+		},
+	}
+	aliases, cleanup := testAliasStore(t, map[string]string{"徐汇": "101"})
+	defer cleanup()
+	for _, c := range cases {
+		v := newRowValidator(c.offlines, aliases)
+		sr := v.AddSheet(table, nil, nil)
+		if sr.Skipped {
+			t.Errorf("%s: sheet skipped: %s", c.name, sr.Reason)
+			continue
+		}
+		if v.report.Rows != 7 || sr.Rows != 7 {
+			t.Errorf("%s: rows %d/%d, want 7", c.name, v.report.Rows, sr.Rows)
+		}
+		if v.report.Accepted != c.accepted || v.report.Duplicated != c.duplicated {
+			t.Errorf("%s: accepted %d, duplicated %d, want %d, %d", c.name, v.report.Accepted, v.report.Duplicated, c.accepted, c.duplicated)
+		}
+		rows := make([]int, 0)
+		for _, e := range v.report.Errors {
+			if e.Sheet != table.Name {
+				t.Errorf("%s: error sheet %q, want %q", c.name, e.Sheet, table.Name)
+			}
+			rows = append(rows, e.Row)
+		}
+		if !reflect.DeepEqual(rows, c.errRows) {
+			t.Errorf("%s: error rows %v, want %v", c.name, rows, c.errRows)
+		}
+		if n := len(v.itemsHash["A1"]); n != c.itemRows {
+			t.Errorf("%s: itemsHash[A1] = %d rows, want %d", c.name, n, c.itemRows)
+		}
+	}
+}
+
+func TestRowValidatorSkipsSheet(t *testing.T) {
+	cases := []struct {
+		table   *reader.Table
+		skipped bool
+	}{
+		{table: &reader.Table{Name: "empty"}, skipped: true},
+		{table: &reader.Table{Name: "notes", Rows: [][]string{{"备注"}, {"x"}}}, skipped: true},
+		{table: &reader.Table{Name: "ok", Rows: [][]string{{"sku", "库存"}, {"S1", "1"}}}, skipped: false},
+	}
+	for _, c := range cases {
+		v := newRowValidator(nil, nil)
+		sr := v.AddSheet(c.table, nil, map[string]string{ColumnShopName: "徐汇店"})
+		if sr.Skipped != c.skipped {
+			t.Errorf("AddSheet(%s) skipped = %v (%s), want %v", c.table.Name, sr.Skipped, sr.Reason, c.skipped)
+		}
+		if !c.skipped && len(v.skuRows["S1"]) != 1 {
+			t.Errorf("AddSheet(%s) skuRows = %v", c.table.Name, v.skuRows)
+		}
+	}
+}
+
+func TestSheetStore(t *testing.T) {
+	v := newRowValidator(testOfflines(), nil)
+	cases := []struct {
+		name string
+		want map[string]string
+	}{
+		{name: "101", want: map[string]string{ColumnOfflineID: "101"}},
+		{name: " 102 ", want: map[string]string{ColumnOfflineID: "102"}},
+		{name: "徐汇店", want: map[string]string{ColumnShopName: "徐汇店"}},
+		{name: "999", want: map[string]string{ColumnShopName: "999"}},
+	}
+	for _, c := range cases {
+		if got := v.sheetStore(c.name); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("sheetStore(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
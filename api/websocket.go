@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 客户端发送的命令
+const (
+	// CmdStart 开始分析，job 已经分析过时重新分析
+	CmdStart = "start"
+	// CmdApprove 审核通过一个 sku
+	CmdApprove = "approve"
+	// CmdReject 拒绝一个 sku
+	CmdReject = "reject"
+	// CmdApply 写回有赞，指定了 sku 时只写回这个 sku，否则写回所有审核通过的 sku，拒绝了的 sku 不会写回
+	CmdApply = "apply"
+)
+
+// 服务端除了分析事件之外发送的消息类型
+const (
+	EventAck = "ack"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// 和 cors 设置保持一致，允许所有来源
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type wsCommand struct {
+	Cmd       string `json:"cmd"`
+	ItemID    int64  `json:"item_id"`
+	OfflineID int64  `json:"offline_id"`
+	SkuID     int64  `json:"sku_id"`
+}
+
+func (cmd *wsCommand) key() string {
+	return skuKey(cmd.ItemID, cmd.OfflineID, cmd.SkuID)
+}
+
+type wsAck struct {
+	Cmd string `json:"cmd"`
+	Key string `json:"key,omitempty"`
+	Msg string `json:"msg,omitempty"`
+}
+
+// wsConn gorilla/websocket 不允许并发写，所有写操作都经过 send
+type wsConn struct {
+	conn *websocket.Conn
+	sync.Mutex
+}
+
+func (c *wsConn) send(e *analysisEvent) error {
+	c.Lock()
+	defer c.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	return c.conn.WriteJSON(e)
+}
+
+func (c *wsConn) ping() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*10))
+}
+
+// JobWebsocket 双向通道：推送和 /jobs/:id/parsing 相同的事件，接收审核和写回命令
+func (a *Api) JobWebsocket(c *gin.Context) {
+	job, err := a.jobs.Get(c.Param("id"))
+	if err != nil {
+		RespErr(c, err, "任务不存在")
+		return
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logrus.Errorf("websocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ws := &wsConn{conn: conn}
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	job.Subscribe()
+	defer job.Unsubscribe(resumeGrace)
+
+	if job.CurrentStatus() == JobStatusInit {
+		if err := a.startAnalysis(job); err != nil && err != ErrJobRunning {
+			ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: err.Error()}})
+			return
+		}
+	}
+
+	var forwarders sync.WaitGroup
+	forward := func(events *eventLog, lastID int) {
+		forwarders.Add(1)
+		go func() {
+			defer forwarders.Done()
+			a.forwardJobEvents(ctx, ws, events, lastID)
+		}()
+	}
+	if events := job.Events(); events != nil {
+		forward(events, lastEventID(c))
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second * 30)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ws.ping(); err != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		cmd := &wsCommand{}
+		if err := conn.ReadJSON(cmd); err != nil {
+			logrus.Debugf("websocket of job %s closed: %v", job.ID, err)
+			break
+		}
+		switch cmd.Cmd {
+		case CmdStart:
+			if err := a.startAnalysis(job); err != nil {
+				ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: err.Error()}})
+				continue
+			}
+			forward(job.Events(), 0)
+			ws.send(&analysisEvent{Type: EventAck, Data: &wsAck{Cmd: cmd.Cmd}})
+		case CmdApprove, CmdReject:
+			decision := DecisionApproved
+			if cmd.Cmd == CmdReject {
+				decision = DecisionRejected
+			}
+			job.SetDecision(cmd.key(), decision)
+			ws.send(&analysisEvent{Type: EventAck, Data: &wsAck{Cmd: cmd.Cmd, Key: cmd.key()}})
+		case CmdApply:
+			go a.applyFromWebsocket(ctx, ws, job, cmd)
+		default:
+			ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: "未知命令: " + cmd.Cmd}})
+		}
+	}
+	cancel()
+	forwarders.Wait()
+}
+
+// forwardJobEvents 推送 lastID 之后的分析事件，直到分析结束或连接断开
+func (a *Api) forwardJobEvents(ctx context.Context, ws *wsConn, events *eventLog, lastID int) {
+	for {
+		list, changed, closed := events.Since(lastID)
+		for _, e := range list {
+			if err := ws.send(e); err != nil {
+				return
+			}
+			lastID = e.ID
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Api) applyFromWebsocket(ctx context.Context, ws *wsConn, job *Job, cmd *wsCommand) {
+	if job.CurrentStatus() != JobStatusParsed {
+		ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: "分析完成后才能写回"}})
+		return
+	}
+	if err := job.BeginApply(); err != nil {
+		ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: "正在写回，请等待上一次写回结束"}})
+		return
+	}
+	defer job.EndApply()
+	decisions := job.CurrentDecisions()
+	goods := job.SelectSkus(func(gu *goodUpdated, sku *goodUpdatedSku) bool {
+		key := skuKey(gu.ItemID, gu.OfflineID, sku.ID)
+		if cmd.SkuID != 0 {
+			return key == cmd.key()
+		}
+		return decisions[key] == DecisionApproved
+	})
+	// 和 HTTP 写回一样，有不能写回的 sku 时整个命令都不执行
+	goods, blocked, rejected, _ := job.ResolveApply(goods)
+	if len(blocked) > 0 {
+		ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: fmt.Sprintf("%d 个 sku 需要审批后才能写回: %s", len(blocked), strings.Join(blocked, ", "))}})
+		return
+	}
+	if len(rejected) > 0 {
+		ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: fmt.Sprintf("%d 个 sku 已经被拒绝，不能写回: %s", len(rejected), strings.Join(rejected, ", "))}})
+		return
+	}
+	tasks := a.buildApplyTasks(goods)
+	if len(tasks) == 0 {
+		ws.send(&analysisEvent{Type: EventError, Data: &analysisFailure{Msg: "没有需要同步的 sku"}})
+		return
+	}
+	ws.send(&analysisEvent{Type: EventAck, Data: &wsAck{Cmd: cmd.Cmd, Key: cmd.key()}})
+	summary := a.applyTasks(ctx, job, tasks, func(id int, result *applyResult) {
+		ws.send(&analysisEvent{Type: EventApplyResult, Data: result})
+	}, func() {})
+	if summary != nil {
+		ws.send(&analysisEvent{Type: EventApplyDone, Data: summary})
+	}
+}
@@ -0,0 +1,148 @@
+package limited_request
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window 固定时间窗口内的调用上限，例如每分钟、每天的配额
+type Window struct {
+	Duration time.Duration
+	Limit    int
+}
+
+type windowCounter struct {
+	Window
+	start time.Time
+	count int
+}
+
+// alignWindow 按本地时间对齐窗口，每天的配额在本地零点重置
+func alignWindow(now time.Time, d time.Duration) time.Time {
+	_, offset := now.Zone()
+	shift := time.Duration(offset) * time.Second
+	return now.Add(shift).Truncate(d).Add(-shift)
+}
+
+func (w *windowCounter) roll(now time.Time) {
+	if start := alignWindow(now, w.Duration); !start.Equal(w.start) {
+		w.start = start
+		w.count = 0
+	}
+}
+
+// Limiter 令牌桶加上若干个配额窗口，所有条件都满足才允许发出请求
+// 多个 Request 可以共用一个 Limiter，使每分钟、每天的配额在所有任务间共享
+type Limiter struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	windows []*windowCounter
+	sync.Mutex
+}
+
+// NewLimiter rate 为每秒补充的令牌数，小于等于 0 时不限制速率；burst 为令牌桶容量，最小为 1
+func NewLimiter(rate float64, burst int, windows ...Window) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+	for _, w := range windows {
+		if w.Duration <= 0 || w.Limit <= 0 {
+			continue
+		}
+		l.windows = append(l.windows, &windowCounter{Window: w})
+	}
+	return l
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	for _, w := range l.windows {
+		w.roll(now)
+	}
+}
+
+// Reserve 尝试取得一个请求名额，取得时返回 0，否则返回至少还需要等待的时间
+func (l *Limiter) Reserve(now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	l.refill(now)
+	var wait time.Duration
+	if l.rate > 0 && l.tokens < 1 {
+		wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	for _, w := range l.windows {
+		if w.count >= w.Limit {
+			if d := w.start.Add(w.Duration).Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	if l.rate > 0 {
+		l.tokens--
+	}
+	for _, w := range l.windows {
+		w.count++
+	}
+	return 0
+}
+
+// WindowStatus 配额窗口的剩余情况
+type WindowStatus struct {
+	Duration  time.Duration `json:"duration"`
+	Limit     int           `json:"limit"`
+	Remaining int           `json:"remaining"`
+	ResetAt   time.Time     `json:"reset_at"`
+}
+
+// LimiterStatus 令牌桶和配额窗口的剩余情况
+type LimiterStatus struct {
+	Tokens  float64         `json:"tokens"`
+	Burst   int             `json:"burst"`
+	Windows []*WindowStatus `json:"windows"`
+}
+
+func (l *Limiter) Status() *LimiterStatus {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.refill(now)
+	s := &LimiterStatus{
+		Tokens:  l.tokens,
+		Burst:   int(l.burst),
+		Windows: make([]*WindowStatus, 0, len(l.windows)),
+	}
+	for _, w := range l.windows {
+		s.Windows = append(s.Windows, &WindowStatus{
+			Duration:  w.Duration,
+			Limit:     w.Limit,
+			Remaining: w.Limit - w.count,
+			ResetAt:   w.start.Add(w.Duration),
+		})
+	}
+	return s
+}
+
+func (s *LimiterStatus) String() string {
+	parts := []string{fmt.Sprintf("tokens(%.1f/%d)", s.Tokens, s.Burst)}
+	for _, w := range s.Windows {
+		parts = append(parts, fmt.Sprintf("%s(%d/%d)", w.Duration, w.Remaining, w.Limit))
+	}
+	return strings.Join(parts, ", ")
+}
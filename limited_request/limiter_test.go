@@ -0,0 +1,141 @@
+package limited_request
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlignWindow(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	cases := []struct {
+		now  time.Time
+		d    time.Duration
+		want time.Time
+	}{
+		{
+			now:  time.Date(2018, 3, 5, 10, 30, 15, 0, loc),
+			d:    time.Minute,
+			want: time.Date(2018, 3, 5, 10, 30, 0, 0, loc),
+		},
+		{
+			now:  time.Date(2018, 3, 5, 10, 30, 15, 0, loc),
+			d:    time.Hour * 24,
+			want: time.Date(2018, 3, 5, 0, 0, 0, 0, loc),
+		},
+		{
+			now:  time.Date(2018, 3, 5, 2, 0, 0, 0, loc),
+			d:    time.Hour * 24,
+			want: time.Date(2018, 3, 5, 0, 0, 0, 0, loc),
+		},
+		{
+			now:  time.Date(2018, 3, 5, 23, 59, 59, 0, time.UTC),
+			d:    time.Hour * 24,
+			want: time.Date(2018, 3, 5, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, c := range cases {
+		if got := alignWindow(c.now, c.d); !got.Equal(c.want) {
+			t.Errorf("alignWindow(%s, %s) = %s, want %s", c.now, c.d, got, c.want)
+		}
+	}
+}
+
+func TestLimiterReserve(t *testing.T) {
+	base := time.Date(2018, 3, 5, 10, 30, 0, 0, time.UTC)
+	type step struct {
+		at   time.Duration
+		want time.Duration
+	}
+	cases := []struct {
+		name    string
+		rate    float64
+		burst   int
+		windows []Window
+		steps   []step
+	}{
+		{
+			name:  "burst then refill",
+			rate:  2,
+			burst: 2,
+			steps: []step{
+				{at: 0, want: 0},
+				{at: 0, want: 0},
+				{at: 0, want: time.Millisecond * 500},
+				{at: time.Millisecond * 250, want: time.Millisecond * 250},
+				{at: time.Millisecond * 500, want: 0},
+				{at: time.Millisecond * 500, want: time.Millisecond * 500},
+			},
+		},
+		{
+			name:  "no rate",
+			rate:  0,
+			burst: 1,
+			steps: []step{
+				{at: 0, want: 0},
+				{at: 0, want: 0},
+				{at: 0, want: 0},
+			},
+		},
+		{
+			name:    "minute window",
+			rate:    0,
+			windows: []Window{{Duration: time.Minute, Limit: 2}},
+			steps: []step{
+				{at: time.Second * 10, want: 0},
+				{at: time.Second * 20, want: 0},
+				{at: time.Second * 30, want: time.Second * 30},
+				{at: time.Second * 59, want: time.Second},
+				{at: time.Minute, want: 0},
+			},
+		},
+		{
+			name:    "longest wait wins",
+			rate:    1,
+			burst:   1,
+			windows: []Window{{Duration: time.Minute, Limit: 1}},
+			steps: []step{
+				{at: 0, want: 0},
+				{at: time.Second * 2, want: time.Second * 58},
+				{at: time.Minute, want: 0},
+			},
+		},
+		{
+			name:  "invalid windows are ignored",
+			rate:  0,
+			burst: 1,
+			windows: []Window{
+				{Duration: 0, Limit: 1},
+				{Duration: time.Minute, Limit: 0},
+			},
+			steps: []step{
+				{at: 0, want: 0},
+				{at: 0, want: 0},
+			},
+		},
+	}
+	for _, c := range cases {
+		l := NewLimiter(c.rate, c.burst, c.windows...)
+		l.last = base
+		for i, s := range c.steps {
+			if got := l.Reserve(base.Add(s.at)); got != s.want {
+				t.Errorf("%s: step %d Reserve(+%s) = %s, want %s", c.name, i, s.at, got, s.want)
+			}
+		}
+	}
+}
+
+func TestLimiterWindowRemaining(t *testing.T) {
+	l := NewLimiter(0, 1, Window{Duration: time.Hour * 24, Limit: 5})
+	for i := 0; i < 3; i++ {
+		if wait := l.Reserve(time.Now()); wait != 0 {
+			t.Fatalf("Reserve #%d wait %s, want 0", i, wait)
+		}
+	}
+	s := l.Status()
+	if len(s.Windows) != 1 {
+		t.Fatalf("Status windows = %d, want 1", len(s.Windows))
+	}
+	if w := s.Windows[0]; w.Remaining != 2 || w.Limit != 5 {
+		t.Errorf("window remaining %d/%d, want 2/5", w.Remaining, w.Limit)
+	}
+}
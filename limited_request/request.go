@@ -1,28 +1,36 @@
 package limited_request
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-
-	"github.com/cabernety/gopkg/httplib"
-	"golang.org/x/sync/errgroup"
 )
 
 // Request 在规定的时间间隔内，发送最多指定数量的请求
 type Request interface {
-	Add(ts []*Task)
-	Start() error
+	// Add 把 task 放入队列，ctx 结束或 Stop 后不再添加
+	Add(ctx context.Context, ts []*Task)
+	// Start 开始发送请求，直到 Stop 或 ctx 结束，ctx 会传递到每个发出的请求
+	Start(ctx context.Context) error
 	Stop()
 	Results() <-chan *Task
-	Status() string
+	Status() *Status
 	FinishedCount() int
 }
 
+var ErrTaskDuplicated = errors.New("LimitedRequest task id duplicated")
+
 type Task struct {
 	ID      string
 	URL     string
@@ -30,115 +38,308 @@ type Task struct {
 	Headers map[string]string
 	Method  string
 	Params  map[string]string
-	Body    []byte
+	// Body 发出请求时是 POST 的 body，完成后是返回的 body
+	Body []byte
+	// Err 重试结束后仍然失败的原因，成功时为 nil
+	Err        error
+	StatusCode int
+	// Attempts 已经发出请求的次数
+	Attempts int
+	payload  []byte
 }
 
 type Options struct {
+	// RequestThresholdPerSecond 每秒请求数，Rate 为 0 时使用
 	RequestThresholdPerSecond int
+	// Rate 令牌桶每秒补充的令牌数
+	Rate float64
+	// Burst 令牌桶容量，即允许的突发请求数，默认等于每秒请求数
+	Burst int
+	// Windows 额外的配额窗口，例如每分钟、每天的调用上限
+	Windows []Window
+	// Limiter 不为空时忽略上面的速率设置，用于多个 Request 共享配额
+	Limiter *Limiter
+	// MaxInFlight 同时进行中的请求数上限，默认 10
+	MaxInFlight int
+	// Prepare 在 task 真正发出请求前调用，可以用来写入最新的 access_token 等参数，
+	// 设置 t.Err 时不再发出请求，task 以该错误结束
+	Prepare func(t *Task)
+	// MaxRetries 临时错误的最大重试次数，默认 3 次，小于 0 时不重试
+	MaxRetries int
+	// RetryBaseDelay 第一次重试前的等待时间，之后每次翻倍，默认 500ms
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay 重试等待时间的上限，默认 10s
+	RetryMaxDelay time.Duration
+	// Retryable 判断请求成功返回但 body 表示临时错误的情况，网络错误、429 和 5xx 总是会重试
+	Retryable func(t *Task) bool
+	// HTTPClient 为空时使用带 Timeout 的 http.Client
+	HTTPClient *http.Client
+	// Timeout 单个请求的超时时间，默认 10s，HTTPClient 不为空时不生效
+	Timeout time.Duration
 }
 
 func New(opt *Options) Request {
-	rtp := opt.RequestThresholdPerSecond
+	limiter := opt.Limiter
+	if limiter == nil {
+		rate := opt.Rate
+		if rate <= 0 {
+			rate = float64(opt.RequestThresholdPerSecond)
+		}
+		burst := opt.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(rate))
+		}
+		limiter = NewLimiter(rate, burst, opt.Windows...)
+	}
+	maxRetries := opt.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+	retryBaseDelay := opt.RetryBaseDelay
+	if retryBaseDelay <= 0 {
+		retryBaseDelay = time.Millisecond * 500
+	}
+	retryMaxDelay := opt.RetryMaxDelay
+	if retryMaxDelay <= 0 {
+		retryMaxDelay = time.Second * 10
+	}
+	httpClient := opt.HTTPClient
+	if httpClient == nil {
+		timeout := opt.Timeout
+		if timeout <= 0 {
+			timeout = time.Second * 10
+		}
+		httpClient = &http.Client{Timeout: timeout}
+	}
+	maxInFlight := opt.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = 10
+	}
 	return &request{
-		requestThresholdPerSecond: rtp,
-		taskQueue:                 make(chan *Task, 10),
-		countCh:                   make(chan int, rtp),
-		results:                   make(chan *Task),
-		done:                      make(chan struct{}),
-		workingTasks:              make(map[string]*Task),
+		httpClient:     httpClient,
+		slots:          make(chan struct{}, maxInFlight),
+		limiter:        limiter,
+		prepare:        opt.Prepare,
+		retryable:      opt.Retryable,
+		maxRetries:     maxRetries,
+		retryBaseDelay: retryBaseDelay,
+		retryMaxDelay:  retryMaxDelay,
+		taskQueue:      make(chan *Task, 10),
+		retryQueue:     make(chan *Task),
+		results:        make(chan *Task),
+		done:           make(chan struct{}),
+		workingTasks:   make(map[string]*Task),
 	}
 }
 
 type request struct {
+	httpClient *http.Client
+	// ctx 由 Start 设置，Stop 或外部 ctx 结束时取消所有请求
+	ctx       context.Context
 	taskQueue chan *Task
-	// 用来计数，保证每秒请求数不超过阙值
-	countCh                   chan int
-	requestThresholdPerSecond int
-	results                   chan *Task
-	workingTasks              map[string]*Task
-	total                     int
-	finished                  int
+	// 等待重试的 task，和新 task 一样受速率限制
+	retryQueue chan *Task
+	// 保证请求速率和配额不超过阙值
+	limiter *Limiter
+	// 进行中的请求占用一个位置，保证并发数不超过 MaxInFlight
+	slots          chan struct{}
+	prepare        func(t *Task)
+	retryable      func(t *Task) bool
+	maxRetries     int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	results        chan *Task
+	workingTasks   map[string]*Task
+	total          int
+	finished       int
+	failed         int
 	sync.RWMutex
-	done chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
-func (r *request) Add(ts []*Task) {
+func (r *request) Add(ctx context.Context, ts []*Task) {
 	for _, t := range ts {
 		select {
+		case <-ctx.Done():
+			return
 		case <-r.done:
 			return
 		case r.taskQueue <- t:
+			r.Lock()
 			r.total++
+			r.Unlock()
 		}
 	}
 }
 
-// func (r *request) doTest(t *Task) {
-// 	r.RLock()
-// 	_, ok := r.workingTasks[t.ID]
-// 	r.RUnlock()
-// 	if ok {
-// 		logrus.Error("LimitedRequest task id duplicated(%s)", t.ID)
-// 		return
-// 	}
-// 	r.Lock()
-// 	r.workingTasks[t.ID] = t
-// 	r.Unlock()
-// 	time.Sleep(time.Millisecond * time.Duration(rand.Intn(3000)))
-// 	r.results <- []byte(fmt.Sprintf("task(%s) test string", t.ID))
-// 	r.Lock()
-// 	r.finished++
-// 	delete(r.workingTasks, t.ID)
-// 	r.Unlock()
-// }
 func (r *request) do(t *Task) {
-	r.RLock()
-	_, ok := r.workingTasks[t.ID]
-	r.RUnlock()
-	if ok {
-		logrus.Error("LimitedRequest task id duplicated(%s)", t.ID)
+	r.Lock()
+	if _, ok := r.workingTasks[t.ID]; ok && t.Attempts == 0 {
+		r.Unlock()
+		<-r.slots
+		logrus.Errorf("LimitedRequest task id duplicated(%s)", t.ID)
+		t.Err = ErrTaskDuplicated
+		r.finish(t)
 		return
 	}
-	r.Lock()
 	r.workingTasks[t.ID] = t
 	r.Unlock()
-	var req *httplib.Request
-	if t.Method == "GET" {
-		req = httplib.Get(t.URL)
-		for k, v := range t.Params {
-			req.Param(k, v)
+	if t.Attempts == 0 {
+		t.payload = t.Body
+	}
+	t.Err = nil
+	if r.prepare != nil {
+		r.prepare(t)
+		if t.Err != nil {
+			<-r.slots
+			r.finish(t)
+			return
+		}
+	}
+	t.Attempts++
+	t.StatusCode, t.Body, t.Err = r.send(t)
+	<-r.slots
+	if r.shouldRetry(t) && t.Attempts <= r.maxRetries {
+		delay := r.backoff(t.Attempts)
+		logrus.Debugf("LimitedRequest task %s attempt %d failed(status %d, err %v), retry in %s", t.ID, t.Attempts, t.StatusCode, t.Err, delay)
+		go func() {
+			select {
+			case <-time.After(delay):
+			case <-r.ctx.Done():
+				return
+			}
+			select {
+			case r.retryQueue <- t:
+			case <-r.ctx.Done():
+			}
+		}()
+		return
+	}
+	if t.Err == nil && t.StatusCode >= 400 {
+		t.Err = fmt.Errorf("http status %d", t.StatusCode)
+	}
+	r.finish(t)
+}
+
+func (r *request) send(t *Task) (int, []byte, error) {
+	params := url.Values{}
+	for k, v := range t.Params {
+		params.Set(k, v)
+	}
+	var (
+		u           = t.URL
+		body        []byte
+		contentType string
+	)
+	method := t.Method
+	if method == "" {
+		method = "POST"
+	}
+	if method == "GET" || len(t.payload) > 0 {
+		// 有 body 时参数放在 url 上
+		body = t.payload
+		if len(params) > 0 {
+			sep := "?"
+			if strings.Contains(u, "?") {
+				sep = "&"
+			}
+			u += sep + params.Encode()
 		}
 	} else {
-		req = httplib.Post(t.URL)
-		req.Body(t.Body)
+		body = []byte(params.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(r.ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
-	req.SetTimeout(time.Second*10, time.Second*10)
 	for k, v := range t.Headers {
-		req.Header(k, v)
+		req.Header.Set(k, v)
 	}
-	res, err := req.Response()
+	res, err := r.httpClient.Do(req)
 	if err != nil {
-		// todo
-		panic(err)
+		return 0, nil, err
 	}
+	defer res.Body.Close()
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		// todo
-		panic(err)
+		return res.StatusCode, nil, err
+	}
+	return res.StatusCode, b, nil
+}
+
+func (r *request) shouldRetry(t *Task) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	if t.Err != nil || t.StatusCode == 429 || t.StatusCode >= 500 {
+		return true
+	}
+	return r.retryable != nil && r.retryable(t)
+}
+
+// backoff 指数退避，并在 [d/2, d) 之间随机，避免重试集中在同一时刻
+func (r *request) backoff(attempts int) time.Duration {
+	d := r.retryBaseDelay * time.Duration(1<<uint(attempts-1))
+	if d > r.retryMaxDelay || d <= 0 {
+		d = r.retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// finish 把完成（包括失败）的 task 发送到 results，已经停止时直接丢弃
+func (r *request) finish(t *Task) {
+	select {
+	case r.results <- t:
+	case <-r.ctx.Done():
+		return
 	}
-	t.Body = b
-	r.results <- t
 	r.Lock()
 	r.finished++
-	delete(r.workingTasks, t.ID)
+	if t.Err != nil {
+		r.failed++
+	}
+	if t.Err != ErrTaskDuplicated {
+		delete(r.workingTasks, t.ID)
+	}
 	r.Unlock()
 }
 
-func (r *request) Status() string {
-	return fmt.Sprintf("tasks(%d/%d)", r.finished, r.total)
+// Status 任务进度和剩余配额
+type Status struct {
+	Total       int            `json:"total"`
+	Finished    int            `json:"finished"`
+	Failed      int            `json:"failed"`
+	InFlight    int            `json:"in_flight"`
+	MaxInFlight int            `json:"max_in_flight"`
+	Quota       *LimiterStatus `json:"quota"`
+}
+
+func (s *Status) String() string {
+	return fmt.Sprintf("tasks(%d/%d), failed: %d, in flight: %d/%d, quota: %s", s.Finished, s.Total, s.Failed, s.InFlight, s.MaxInFlight, s.Quota)
+}
+
+func (r *request) Status() *Status {
+	r.RLock()
+	defer r.RUnlock()
+	return &Status{
+		Total:       r.total,
+		Finished:    r.finished,
+		Failed:      r.failed,
+		InFlight:    len(r.slots),
+		MaxInFlight: cap(r.slots),
+		Quota:       r.limiter.Status(),
+	}
 }
 
 func (r *request) FinishedCount() int {
+	r.RLock()
+	defer r.RUnlock()
 	return r.finished
 }
 
@@ -146,36 +347,58 @@ func (r *request) Results() <-chan *Task {
 	return r.results
 }
 
-func (r *request) Start() error {
-
-	var g errgroup.Group
+func (r *request) Start(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	r.ctx = ctx
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	g.Go(func() error {
-		for {
-			// ts := time.Second * time.Duration(1000000/r.requestThresholdPerSecond)
-			select {
-			case <-time.After(time.Millisecond * time.Duration(math.Round(float64(1000/r.requestThresholdPerSecond)))):
-				r.countCh <- 1
-				// logrus.Debugf("countCh <- 1, cap %d", cap(r.countCh))
-			case <-r.done:
-				return nil
-			}
+	for {
+		var t *Task
+		select {
+		case t = <-r.retryQueue:
+		case t = <-r.taskQueue:
+		case <-ctx.Done():
+			return r.stopErr(parent)
 		}
-	})
-	g.Go(func() error {
-		for {
-			t := <-r.taskQueue
+		// 先占用并发位置再取令牌，避免等待位置时浪费配额
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			return r.stopErr(parent)
+		}
+		for d := r.limiter.Reserve(time.Now()); d > 0; d = r.limiter.Reserve(time.Now()) {
+			if d > time.Minute {
+				logrus.Infof("LimitedRequest quota exhausted, wait %s, %s", d, r.limiter.Status())
+			}
 			select {
-			case <-r.countCh:
-				go r.do(t)
-			case <-r.done:
-				return nil
+			case <-time.After(d):
+			case <-ctx.Done():
+				return r.stopErr(parent)
 			}
 		}
-	})
+		go r.do(t)
+	}
+}
 
-	return g.Wait()
+// stopErr Stop 停止时返回 nil，否则返回外部 ctx 的错误
+func (r *request) stopErr(parent context.Context) error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+		return parent.Err()
+	}
 }
+
 func (r *request) Stop() {
-	close(r.done)
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
 }
@@ -0,0 +1,211 @@
+package limited_request
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	r := &request{
+		retryBaseDelay: time.Millisecond * 100,
+		retryMaxDelay:  time.Second,
+	}
+	cases := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{attempts: 1, max: time.Millisecond * 100},
+		{attempts: 2, max: time.Millisecond * 200},
+		{attempts: 3, max: time.Millisecond * 400},
+		{attempts: 5, max: time.Second},
+		{attempts: 64, max: time.Second},
+	}
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			d := r.backoff(c.attempts)
+			if d < c.max/2 || d > c.max {
+				t.Errorf("backoff(%d) = %s, want in [%s, %s]", c.attempts, d, c.max/2, c.max)
+				break
+			}
+		}
+	}
+}
+
+// runTask 用 handler 启动测试服务器，发出一个 task 并返回结果和服务器收到的请求数
+func runTask(t *testing.T, opt *Options, handler func(n int, w http.ResponseWriter)) (*Task, int) {
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		n++
+		i := n
+		mu.Unlock()
+		handler(i, w)
+	}))
+	defer srv.Close()
+
+	opt.Rate = 1000
+	opt.RetryBaseDelay = time.Millisecond
+	opt.RetryMaxDelay = time.Millisecond * 5
+	r := New(opt)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	go r.Start(ctx)
+	defer r.Stop()
+	r.Add(ctx, []*Task{{ID: "1", URL: srv.URL, Params: map[string]string{"a": "1"}}})
+	select {
+	case task := <-r.Results():
+		mu.Lock()
+		defer mu.Unlock()
+		return task, n
+	case <-ctx.Done():
+		t.Fatalf("task not finished: %v", ctx.Err())
+	}
+	return nil, 0
+}
+
+func TestRequestRetry(t *testing.T) {
+	errPrepare := errors.New("prepare failed")
+	cases := []struct {
+		name     string
+		opt      *Options
+		handler  func(n int, w http.ResponseWriter)
+		attempts int
+		requests int
+		status   int
+		err      bool
+	}{
+		{
+			name: "success",
+			opt:  &Options{},
+			handler: func(n int, w http.ResponseWriter) {
+				w.Write([]byte("ok"))
+			},
+			attempts: 1, requests: 1, status: 200,
+		},
+		{
+			name: "5xx then success",
+			opt:  &Options{},
+			handler: func(n int, w http.ResponseWriter) {
+				if n < 3 {
+					w.WriteHeader(503)
+					return
+				}
+				w.Write([]byte("ok"))
+			},
+			attempts: 3, requests: 3, status: 200,
+		},
+		{
+			name: "429 is retried",
+			opt:  &Options{},
+			handler: func(n int, w http.ResponseWriter) {
+				if n == 1 {
+					w.WriteHeader(429)
+					return
+				}
+				w.Write([]byte("ok"))
+			},
+			attempts: 2, requests: 2, status: 200,
+		},
+		{
+			name: "4xx is not retried",
+			opt:  &Options{},
+			handler: func(n int, w http.ResponseWriter) {
+				w.WriteHeader(400)
+			},
+			attempts: 1, requests: 1, status: 400, err: true,
+		},
+		{
+			name: "retries exhausted",
+			opt:  &Options{MaxRetries: 2},
+			handler: func(n int, w http.ResponseWriter) {
+				w.WriteHeader(500)
+			},
+			attempts: 3, requests: 3, status: 500, err: true,
+		},
+		{
+			name: "no retry",
+			opt:  &Options{MaxRetries: -1},
+			handler: func(n int, w http.ResponseWriter) {
+				w.WriteHeader(500)
+			},
+			attempts: 1, requests: 1, status: 500, err: true,
+		},
+		{
+			name: "retryable body",
+			opt: &Options{Retryable: func(t *Task) bool {
+				return string(t.Body) == "busy"
+			}},
+			handler: func(n int, w http.ResponseWriter) {
+				if n == 1 {
+					w.Write([]byte("busy"))
+					return
+				}
+				w.Write([]byte("ok"))
+			},
+			attempts: 2, requests: 2, status: 200,
+		},
+		{
+			name: "prepare error skips request",
+			opt: &Options{Prepare: func(t *Task) {
+				t.Err = errPrepare
+			}},
+			handler: func(n int, w http.ResponseWriter) {
+				w.Write([]byte("ok"))
+			},
+			attempts: 0, requests: 0, status: 0, err: true,
+		},
+	}
+	for _, c := range cases {
+		task, n := runTask(t, c.opt, c.handler)
+		if task.Attempts != c.attempts || n != c.requests {
+			t.Errorf("%s: attempts %d, requests %d, want %d, %d", c.name, task.Attempts, n, c.attempts, c.requests)
+		}
+		if task.StatusCode != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, task.StatusCode, c.status)
+		}
+		if (task.Err != nil) != c.err {
+			t.Errorf("%s: err %v, want error %v", c.name, task.Err, c.err)
+		}
+	}
+}
+
+func TestRequestParams(t *testing.T) {
+	cases := []struct {
+		method string
+		body   []byte
+		query  string
+		form   string
+	}{
+		{method: "GET", query: "a=1"},
+		{method: "POST", form: "a=1"},
+		{method: "POST", body: []byte(`{"x":1}`), query: "a=1"},
+	}
+	for _, c := range cases {
+		var gotQuery, gotForm string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotQuery = req.URL.RawQuery
+			if req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+				req.ParseForm()
+				gotForm = req.PostForm.Encode()
+			}
+		}))
+		r := &request{httpClient: srv.Client(), ctx: context.Background()}
+		_, _, err := r.send(&Task{URL: srv.URL, Method: c.method, Params: map[string]string{"a": "1"}, payload: c.body})
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s %s: %v", c.method, c.body, err)
+			continue
+		}
+		if gotQuery != c.query || gotForm != c.form {
+			t.Errorf("%s %s: query %q, form %q, want %q, %q", c.method, c.body, gotQuery, gotForm, c.query, c.form)
+		}
+	}
+}
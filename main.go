@@ -1,14 +1,82 @@
 package main
 
 import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/xuyuntech/inventory_sync_go/api"
+	limitedRequest "github.com/xuyuntech/inventory_sync_go/limited_request"
+	"github.com/xuyuntech/inventory_sync_go/youzan"
+)
+
+var (
+	youzanBaseURL      = flag.String("youzan-base-url", youzan.DefaultBaseURL, "有赞开放平台接口地址")
+	youzanAccessToken  = flag.String("youzan-access-token", os.Getenv("YOUZAN_ACCESS_TOKEN"), "固定的有赞 access_token, 设置了 client_id 时不生效")
+	youzanClientID     = flag.String("youzan-client-id", os.Getenv("YOUZAN_CLIENT_ID"), "有赞自用型应用 client_id")
+	youzanClientSecret = flag.String("youzan-client-secret", os.Getenv("YOUZAN_CLIENT_SECRET"), "有赞自用型应用 client_secret")
+	youzanKdtID        = flag.String("youzan-kdt-id", os.Getenv("YOUZAN_KDT_ID"), "有赞店铺 ID")
+	youzanRate         = flag.Float64("youzan-rate", 3, "每秒调用有赞接口的次数")
+	youzanBurst        = flag.Int("youzan-burst", 3, "允许突发调用有赞接口的次数")
+	youzanPerMinute    = flag.Int("youzan-per-minute", 0, "每分钟调用有赞接口的上限, 0 表示不限制")
+	youzanPerDay       = flag.Int("youzan-per-day", 0, "每天调用有赞接口的上限, 0 表示不限制")
+	youzanMaxInFlight  = flag.Int("youzan-max-in-flight", 10, "每个任务同时进行中的有赞请求数上限")
+	youzanTimeout      = flag.Duration("youzan-timeout", time.Second*10, "单次调用有赞接口的超时时间")
+	approvers          = flag.String("approvers", os.Getenv("APPROVERS"), "审批人, 格式为 name:token,name:token")
+	planSecret         = flag.String("plan-secret", os.Getenv("PLAN_SECRET"), "修改计划的签名密钥, 为空时不签名")
+	dataDir            = flag.String("data-dir", "data", "列映射、门店别名、对比和转换规则等配置的保存目录")
+	jobTTL             = flag.Duration("job-ttl", api.DefaultJobTTL, "任务最后一次更新之后在内存中保留的时间")
+	maxJobs            = flag.Int("max-jobs", api.DefaultMaxJobs, "内存中最多保留的任务数")
 )
 
 func main() {
+	flag.Parse()
 	logrus.SetLevel(logrus.DebugLevel)
-	a := api.New()
+	var tokens youzan.TokenProvider
+	if *youzanClientID != "" {
+		tokens = youzan.NewSilentTokenProvider(&youzan.SilentTokenOptions{
+			ClientID:     *youzanClientID,
+			ClientSecret: *youzanClientSecret,
+			KdtID:        *youzanKdtID,
+		})
+	}
+	a, err := api.New(&api.Options{
+		Youzan: youzan.NewClient(&youzan.Options{
+			BaseURL:       *youzanBaseURL,
+			AccessToken:   *youzanAccessToken,
+			TokenProvider: tokens,
+			Timeout:       *youzanTimeout,
+		}),
+		Limiter: limitedRequest.NewLimiter(*youzanRate, *youzanBurst,
+			limitedRequest.Window{Duration: time.Minute, Limit: *youzanPerMinute},
+			limitedRequest.Window{Duration: time.Hour * 24, Limit: *youzanPerDay},
+		),
+		MaxInFlight: *youzanMaxInFlight,
+		DataDir:     *dataDir,
+		Approvers:   parseApprovers(*approvers),
+		PlanSecret:  *planSecret,
+		JobTTL:      *jobTTL,
+		MaxJobs:     *maxJobs,
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	if err := a.Run(); err != nil {
 		logrus.Fatal(err)
 	}
 }
+
+// parseApprovers 解析 name:token,name:token 格式的审批人
+func parseApprovers(s string) map[string]string {
+	approvers := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		approvers[parts[1]] = parts[0]
+	}
+	return approvers
+}
@@ -0,0 +1,175 @@
+// Package money 用整数表示金额（分）和库存，避免 float64 比较时 12.30 和 12.299999 被当作不同的值
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidNumber = errors.New("不是数字")
+	ErrNotInteger    = errors.New("库存必须是整数")
+)
+
+// Money 金额，单位为分
+type Money int64
+
+// ParseMoney 按十进制精确解析金额，例如 "12.3"、"12.30"、"￥1,299.00"，超过两位的小数四舍五入
+func ParseMoney(s string) (Money, error) {
+	d, err := parseDecimal(s)
+	if err != nil {
+		return 0, err
+	}
+	v, err := d.round(2)
+	return Money(v), err
+}
+
+// Yuan 以元为单位的浮点数，用于计算比例等不要求精确的场景
+func (m Money) Yuan() float64 {
+	return float64(m) / 100
+}
+
+// String 保留两位小数，例如 "12.30"
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/100, v%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON 接受数字和字符串两种形式
+func (m *Money) UnmarshalJSON(b []byte) error {
+	v, err := ParseMoney(unquote(b))
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// Stock 库存数量
+type Stock int64
+
+// ParseStock 解析库存，允许 "10.0" 和 excel 浮点误差导致的 "9.9999999999"，真正的小数返回 ErrNotInteger
+func ParseStock(s string) (Stock, error) {
+	d, err := parseDecimal(s)
+	if err != nil {
+		return 0, err
+	}
+	v, err := d.round(0)
+	if err != nil {
+		return 0, err
+	}
+	if exact, _ := d.round(6); exact != v*1000000 {
+		return 0, ErrNotInteger
+	}
+	return Stock(v), nil
+}
+
+func (s Stock) String() string {
+	return strconv.FormatInt(int64(s), 10)
+}
+
+func (s *Stock) UnmarshalJSON(b []byte) error {
+	v, err := ParseStock(unquote(b))
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+func unquote(b []byte) string {
+	str := string(b)
+	if len(str) >= 2 && str[0] == '"' && str[len(str)-1] == '"' {
+		return str[1 : len(str)-1]
+	}
+	return str
+}
+
+// decimal 十进制数的整数部分和小数部分的数字
+type decimal struct {
+	negative bool
+	integer  string
+	fraction string
+}
+
+func parseDecimal(s string) (*decimal, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimLeft(s, "￥¥$")
+	s = strings.Replace(s, ",", "", -1)
+	d := &decimal{}
+	if strings.HasPrefix(s, "-") {
+		d.negative = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	parts := strings.SplitN(s, ".", 2)
+	d.integer = parts[0]
+	if len(parts) == 2 {
+		d.fraction = parts[1]
+	}
+	if d.integer == "" && d.fraction == "" {
+		return nil, ErrInvalidNumber
+	}
+	for _, c := range d.integer + d.fraction {
+		if c < '0' || c > '9' {
+			// excel 里的大数可能是科学计数法，精度已经丢失，按浮点数解析
+			return parseScientific(s, d.negative)
+		}
+	}
+	return d, nil
+}
+
+// scientificPattern 十进制的科学计数法，例如 "1.23E+11"，不接受十六进制、下划线、Inf 等 ParseFloat 支持的其它形式
+var scientificPattern = regexp.MustCompile(`^([0-9]+\.?[0-9]*|\.[0-9]+)[eE][+-]?[0-9]+$`)
+
+func parseScientific(s string, negative bool) (*decimal, error) {
+	if !scientificPattern.MatchString(s) {
+		return nil, ErrInvalidNumber
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, ErrInvalidNumber
+	}
+	d, err := parseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+	if err != nil {
+		return nil, err
+	}
+	d.negative = negative
+	return d, nil
+}
+
+// round 保留 places 位小数四舍五入，返回乘以 10^places 之后的整数
+func (d *decimal) round(places int) (int64, error) {
+	fraction := d.fraction
+	for len(fraction) < places+1 {
+		fraction += "0"
+	}
+	digits := strings.TrimLeft(d.integer+fraction[:places], "0")
+	if digits == "" {
+		digits = "0"
+	}
+	v, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidNumber
+	}
+	if fraction[places] >= '5' {
+		v++
+	}
+	if d.negative {
+		v = -v
+	}
+	return v, nil
+}
@@ -0,0 +1,157 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Money
+		err  bool
+	}{
+		{in: "12.3", want: 1230},
+		{in: "12.30", want: 1230},
+		{in: " 12 ", want: 1200},
+		{in: "0", want: 0},
+		{in: ".5", want: 50},
+		{in: "5.", want: 500},
+		{in: "-1.5", want: -150},
+		{in: "+1.5", want: 150},
+		{in: "￥1,299.00", want: 129900},
+		{in: "¥8.8", want: 880},
+		{in: "$0.01", want: 1},
+		{in: "12.345", want: 1235},
+		{in: "12.344", want: 1234},
+		{in: "0.005", want: 1},
+		{in: "1.23E+2", want: 12300},
+		{in: "1.5e1", want: 1500},
+		{in: "-2e1", want: -2000},
+		{in: "", err: true},
+		{in: ".", err: true},
+		{in: "-", err: true},
+		{in: "abc", err: true},
+		{in: "12a", err: true},
+		{in: "1.2.3", err: true},
+		{in: "0x1p3", err: true},
+		{in: "1_000", err: true},
+		{in: "Inf", err: true},
+		{in: "NaN", err: true},
+		{in: "1e400", err: true},
+		{in: "e5", err: true},
+		{in: "--1", err: true},
+	}
+	for _, c := range cases {
+		got, err := ParseMoney(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("ParseMoney(%q) = %d, want error", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseMoney(%q) error: %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseStock(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Stock
+		err  error
+	}{
+		{in: "10", want: 10},
+		{in: "10.0", want: 10},
+		{in: "10.000000", want: 10},
+		{in: "9.9999999999", want: 10},
+		{in: "-3", want: -3},
+		{in: "1,000", want: 1000},
+		{in: "1E+3", want: 1000},
+		{in: "10.5", err: ErrNotInteger},
+		{in: "10.001", err: ErrNotInteger},
+		{in: "", err: ErrInvalidNumber},
+		{in: "ten", err: ErrInvalidNumber},
+		{in: "0x1p3", err: ErrInvalidNumber},
+		{in: "0x10", err: ErrInvalidNumber},
+		{in: "1_000", err: ErrInvalidNumber},
+		{in: "99999999999999999999", err: ErrInvalidNumber},
+	}
+	for _, c := range cases {
+		got, err := ParseStock(c.in)
+		if err != c.err {
+			t.Errorf("ParseStock(%q) error = %v, want %v", c.in, err, c.err)
+			continue
+		}
+		if err == nil && got != c.want {
+			t.Errorf("ParseStock(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	cases := []struct {
+		in   Money
+		want string
+	}{
+		{0, "0.00"},
+		{1, "0.01"},
+		{1230, "12.30"},
+		{-5, "-0.05"},
+		{-129900, "-1299.00"},
+	}
+	for _, c := range cases {
+		if got := c.in.String(); got != c.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(c.in), got, c.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type sku struct {
+		Price    Money `json:"price"`
+		Quantity Stock `json:"quantity"`
+	}
+	cases := []struct {
+		in   string
+		want sku
+		err  bool
+	}{
+		{in: `{"price":12.3,"quantity":5}`, want: sku{1230, 5}},
+		{in: `{"price":"12.30","quantity":"5"}`, want: sku{1230, 5}},
+		{in: `{"price":0.1,"quantity":5.0}`, want: sku{10, 5}},
+		{in: `{"price":"abc","quantity":5}`, err: true},
+		{in: `{"price":1,"quantity":1.5}`, err: true},
+	}
+	for _, c := range cases {
+		got := sku{}
+		err := json.Unmarshal([]byte(c.in), &got)
+		if c.err {
+			if err == nil {
+				t.Errorf("Unmarshal(%s) = %+v, want error", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unmarshal(%s) error: %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", c.in, got, c.want)
+		}
+		b, err := json.Marshal(got)
+		if err != nil {
+			t.Errorf("Marshal(%+v) error: %v", got, err)
+			continue
+		}
+		again := sku{}
+		if err := json.Unmarshal(b, &again); err != nil || again != got {
+			t.Errorf("round trip of %+v = %+v (%s), err: %v", got, again, b, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package reader
+
+import (
+	"bytes"
+	"encoding/csv"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// CSVReader 读取 csv 和制表符分隔的文件，不是 utf-8 时按 GBK 解码
+type CSVReader struct{}
+
+func (r *CSVReader) Read(b []byte) ([]*Table, error) {
+	b, err := decodeText(b)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(bytes.NewReader(b))
+	reader.Comma = detectComma(b)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return []*Table{{Name: "csv", Rows: rows}}, nil
+}
+
+// decodeText 去掉 utf-8 BOM，不是合法 utf-8 的内容当作 GB18030（兼容 GBK）解码
+func decodeText(b []byte) ([]byte, error) {
+	if bytes.HasPrefix(b, utf8BOM) {
+		return b[len(utf8BOM):], nil
+	}
+	if utf8.Valid(b) {
+		return b, nil
+	}
+	return simplifiedchinese.GB18030.NewDecoder().Bytes(b)
+}
+
+// detectComma 按第一行里出现次数最多的分隔符判断
+func detectComma(b []byte) rune {
+	line := b
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line = b[:i]
+	}
+	comma, max := ',', bytes.Count(line, []byte{','})
+	for _, c := range []rune{'\t', ';'} {
+		if n := bytes.Count(line, []byte(string(c))); n > max {
+			comma, max = c, n
+		}
+	}
+	return comma
+}
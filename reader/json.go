@@ -0,0 +1,72 @@
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// JSONReader 读取对象数组，Lines 为 true 时每行一个对象（NDJSON）
+// 对象的 key 作为表头，例如 {"item_no": "A001", "shop_name": "一店", "quantity": 10, "price": 9.9}
+type JSONReader struct {
+	Lines bool
+}
+
+func (r *JSONReader) Read(b []byte) ([]*Table, error) {
+	objects := make([]map[string]interface{}, 0)
+	if r.Lines {
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			obj := make(map[string]interface{})
+			if err := decodeJSON(text, &obj); err != nil {
+				return nil, fmt.Errorf("第 %d 行不是合法的 json: %v", line, err)
+			}
+			objects = append(objects, obj)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if err := decodeJSON(b, &objects); err != nil {
+		return nil, err
+	}
+	return []*Table{objectsToTable(objects)}, nil
+}
+
+func decodeJSON(b []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func objectsToTable(objects []map[string]interface{}) *Table {
+	keys := make(map[string]bool)
+	header := make([]string, 0)
+	for _, obj := range objects {
+		for k := range obj {
+			if !keys[k] {
+				keys[k] = true
+				header = append(header, k)
+			}
+		}
+	}
+	sort.Strings(header)
+	rows := make([][]string, 0, len(objects)+1)
+	rows = append(rows, header)
+	for _, obj := range objects {
+		cells := make([]string, len(header))
+		for i, k := range header {
+			if v, ok := obj[k]; ok && v != nil {
+				cells[i] = fmt.Sprint(v)
+			}
+		}
+		rows = append(rows, cells)
+	}
+	return &Table{Name: "json", Rows: rows}
+}
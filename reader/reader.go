@@ -0,0 +1,83 @@
+// Package reader 把不同格式的库存文件读成统一的表格，交给 api 按表头识别列
+package reader
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsupportedFormat = errors.New("不支持的文件格式")
+
+// Table 一个 sheet，Rows[0] 为表头
+type Table struct {
+	Name string
+	Rows [][]string
+}
+
+// Reader 把文件内容读成一个或多个 Table
+type Reader interface {
+	Read(b []byte) ([]*Table, error)
+}
+
+type format struct {
+	reader       Reader
+	extensions   []string
+	contentTypes []string
+}
+
+var formats = make([]*format, 0)
+
+// Register 注册一种格式，extensions 带点号，例如 ".csv"
+func Register(r Reader, extensions []string, contentTypes []string) {
+	formats = append(formats, &format{
+		reader:       r,
+		extensions:   extensions,
+		contentTypes: contentTypes,
+	})
+}
+
+func init() {
+	Register(&XLSXReader{}, []string{".xlsx"}, []string{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"})
+	Register(&XLSReader{}, []string{".xls"}, []string{"application/vnd.ms-excel"})
+	Register(&CSVReader{}, []string{".csv", ".tsv", ".txt"}, []string{"text/csv", "text/tab-separated-values", "text/plain"})
+	Register(&JSONReader{}, []string{".json"}, []string{"application/json"})
+	Register(&JSONReader{Lines: true}, []string{".ndjson", ".jsonl"}, []string{"application/x-ndjson", "application/jsonl"})
+}
+
+var (
+	// xlsx 是 zip 包，xls 是 OLE2 复合文档
+	xlsxMagic = []byte("PK\x03\x04")
+	xlsMagic  = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+)
+
+// ForFile 选择读取文件的 Reader，依次按文件头、扩展名和 content type 判断
+// 浏览器上传的 content type 不可靠，例如 Windows 下 .csv 文件的 content type 是 application/vnd.ms-excel
+func ForFile(fileName string, contentType string, b []byte) (Reader, error) {
+	switch {
+	case bytes.HasPrefix(b, xlsxMagic):
+		return &XLSXReader{}, nil
+	case bytes.HasPrefix(b, xlsMagic):
+		return &XLSReader{}, nil
+	}
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, f := range formats {
+		for _, e := range f.extensions {
+			if e == ext {
+				return f.reader, nil
+			}
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		for _, f := range formats {
+			for _, ct := range f.contentTypes {
+				if ct == mediaType {
+					return f.reader, nil
+				}
+			}
+		}
+	}
+	return nil, ErrUnsupportedFormat
+}
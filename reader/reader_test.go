@@ -0,0 +1,174 @@
+package reader
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tealeg/xlsx"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestForFile(t *testing.T) {
+	cases := []struct {
+		fileName    string
+		contentType string
+		b           []byte
+		want        Reader
+		err         error
+	}{
+		{fileName: "a.xlsx", b: []byte("PK\x03\x04..."), want: &XLSXReader{}},
+		// 文件头优先于扩展名和 content type
+		{fileName: "a.csv", contentType: "text/csv", b: []byte("PK\x03\x04..."), want: &XLSXReader{}},
+		{fileName: "a.xlsx", b: []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1, 0}, want: &XLSReader{}},
+		// Windows 下 .csv 的 content type 是 application/vnd.ms-excel
+		{fileName: "a.CSV", contentType: "application/vnd.ms-excel", b: []byte("a,b\n"), want: &CSVReader{}},
+		{fileName: "a.tsv", b: []byte("a\tb\n"), want: &CSVReader{}},
+		{fileName: "a.json", b: []byte("[]"), want: &JSONReader{}},
+		{fileName: "a.jsonl", b: []byte("{}\n"), want: &JSONReader{Lines: true}},
+		{fileName: "upload", contentType: "text/csv; charset=gbk", b: []byte("a,b\n"), want: &CSVReader{}},
+		{fileName: "upload", contentType: "application/x-ndjson", b: []byte("{}\n"), want: &JSONReader{Lines: true}},
+		{fileName: "a.pdf", contentType: "application/pdf", b: []byte("%PDF"), err: ErrUnsupportedFormat},
+		{fileName: "upload", b: []byte("a,b\n"), err: ErrUnsupportedFormat},
+	}
+	for _, c := range cases {
+		got, err := ForFile(c.fileName, c.contentType, c.b)
+		if err != c.err {
+			t.Errorf("ForFile(%q, %q) error = %v, want %v", c.fileName, c.contentType, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ForFile(%q, %q) = %#v, want %#v", c.fileName, c.contentType, got, c.want)
+		}
+	}
+}
+
+func gbk(t *testing.T, s string) []byte {
+	b, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCSVReader(t *testing.T) {
+	cases := []struct {
+		name string
+		b    []byte
+		want [][]string
+	}{
+		{
+			name: "utf-8",
+			b:    []byte("商品编码,门店,库存\nA1,徐汇店,10\n"),
+			want: [][]string{{"商品编码", "门店", "库存"}, {"A1", "徐汇店", "10"}},
+		},
+		{
+			name: "utf-8 bom",
+			b:    append([]byte{0xEF, 0xBB, 0xBF}, "商品编码,库存\nA1,10\n"...),
+			want: [][]string{{"商品编码", "库存"}, {"A1", "10"}},
+		},
+		{
+			name: "gbk",
+			b:    gbk(t, "商品编码,门店,库存\r\nA1,徐汇店,10\r\n"),
+			want: [][]string{{"商品编码", "门店", "库存"}, {"A1", "徐汇店", "10"}},
+		},
+		{
+			name: "tab",
+			b:    []byte("商品编码\t门店\t价格\nA1\t徐汇店\t1,299.00\n"),
+			want: [][]string{{"商品编码", "门店", "价格"}, {"A1", "徐汇店", "1,299.00"}},
+		},
+		{
+			name: "semicolon and ragged rows",
+			b:    []byte("a;b;c\n1;2\n"),
+			want: [][]string{{"a", "b", "c"}, {"1", "2"}},
+		},
+	}
+	for _, c := range cases {
+		tables, err := (&CSVReader{}).Read(c.b)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(tables) != 1 {
+			t.Errorf("%s: %d tables, want 1", c.name, len(tables))
+			continue
+		}
+		if !reflect.DeepEqual(tables[0].Rows, c.want) {
+			t.Errorf("%s: rows = %q, want %q", c.name, tables[0].Rows, c.want)
+		}
+	}
+}
+
+func TestJSONReader(t *testing.T) {
+	cases := []struct {
+		name  string
+		lines bool
+		b     string
+		want  [][]string
+		err   bool
+	}{
+		{
+			name: "array",
+			b:    `[{"item_no": "A1", "quantity": 10, "price": 12.30}, {"item_no": "A2", "quantity": null}]`,
+			want: [][]string{{"item_no", "price", "quantity"}, {"A1", "12.30", "10"}, {"A2", "", ""}},
+		},
+		{
+			name:  "lines",
+			lines: true,
+			b:     "{\"item_no\": \"A1\"}\n\n{\"sku_no\": \"S1\"}\n",
+			want:  [][]string{{"item_no", "sku_no"}, {"A1", ""}, {"", "S1"}},
+		},
+		{
+			name:  "bad line",
+			lines: true,
+			b:     "{\"item_no\": \"A1\"}\n{bad\n",
+			err:   true,
+		},
+	}
+	for _, c := range cases {
+		tables, err := (&JSONReader{Lines: c.lines}).Read([]byte(c.b))
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: want error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tables[0].Rows, c.want) {
+			t.Errorf("%s: rows = %q, want %q", c.name, tables[0].Rows, c.want)
+		}
+	}
+}
+
+func TestXLSXReaderKeepsRowNumbers(t *testing.T) {
+	file := xlsx.NewFile()
+	sheet, err := file.AddSheet("徐汇店")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cells := range [][]string{{"商品编码", "库存"}, {}, {"A1", "10"}} {
+		row := sheet.AddRow()
+		for _, v := range cells {
+			row.AddCell().SetString(v)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := file.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := (&XLSXReader{}).Read(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0].Name != "徐汇店" {
+		t.Fatalf("tables = %#v", tables)
+	}
+	rows := tables[0].Rows
+	if len(rows) != 3 || strings.Join(rows[1], "") != "" || !reflect.DeepEqual(rows[2], []string{"A1", "10"}) {
+		t.Errorf("rows = %q, want the data row to stay on row 3", rows)
+	}
+}
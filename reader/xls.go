@@ -0,0 +1,52 @@
+package reader
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/extrame/xls"
+)
+
+// XLSReader 读取 excel 97-2003 格式的 .xls 文件
+type XLSReader struct{}
+
+func (r *XLSReader) Read(b []byte) (tables []*Table, err error) {
+	// extrame/xls 遇到损坏的文件会 panic
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("读取 xls 文件出错: %v", e)
+		}
+	}()
+	wb, err := xls.OpenReader(bytes.NewReader(b), "utf-8")
+	if err != nil {
+		return nil, err
+	}
+	tables = make([]*Table, 0, wb.NumSheets())
+	for i := 0; i < wb.NumSheets(); i++ {
+		sheet := wb.GetSheet(i)
+		if sheet == nil {
+			continue
+		}
+		table := &Table{Name: sheet.Name, Rows: make([][]string, 0, int(sheet.MaxRow)+1)}
+		for k := 0; k <= int(sheet.MaxRow); k++ {
+			table.Rows = append(table.Rows, xlsRow(sheet, k))
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// xlsRow 读出一行的单元格，sheet.Row 在空行时会 panic，这里当作空行处理
+func xlsRow(sheet *xls.WorkSheet, i int) (cells []string) {
+	defer func() {
+		if recover() != nil {
+			cells = []string{}
+		}
+	}()
+	row := sheet.Row(i)
+	cells = make([]string, row.LastCol())
+	for col := row.FirstCol(); col < row.LastCol(); col++ {
+		cells[col] = row.Col(col)
+	}
+	return cells
+}
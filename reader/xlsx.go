@@ -0,0 +1,32 @@
+package reader
+
+import (
+	"github.com/tealeg/xlsx"
+)
+
+type XLSXReader struct{}
+
+func (r *XLSXReader) Read(b []byte) ([]*Table, error) {
+	file, err := xlsx.OpenBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]*Table, 0, len(file.Sheets))
+	for _, sheet := range file.Sheets {
+		table := &Table{Name: sheet.Name, Rows: make([][]string, 0, len(sheet.Rows))}
+		for _, row := range sheet.Rows {
+			// 空行也要保留，行号才能和 excel 里的一致
+			if row == nil {
+				table.Rows = append(table.Rows, []string{})
+				continue
+			}
+			cells := make([]string, 0, len(row.Cells))
+			for _, cell := range row.Cells {
+				cells = append(cells, cell.Value)
+			}
+			table.Rows = append(table.Rows, cells)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
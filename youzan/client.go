@@ -0,0 +1,124 @@
+package youzan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL 有赞开放平台接口地址
+const DefaultBaseURL = "https://open.youzan.com/api/oauthentry"
+
+type Options struct {
+	// BaseURL 默认为 DefaultBaseURL，测试时可以指向本地的假服务
+	BaseURL string
+	// AccessToken 固定的 token，TokenProvider 为空时使用
+	AccessToken   string
+	TokenProvider TokenProvider
+	// HTTPClient 为空时使用带 Timeout 的 http.Client
+	HTTPClient *http.Client
+	// Timeout 默认 10s，HTTPClient 不为空时不生效
+	Timeout time.Duration
+}
+
+// Client 对应一个有赞店铺的接口调用
+type Client struct {
+	baseURL    string
+	tokens     TokenProvider
+	httpClient *http.Client
+}
+
+func NewClient(opt *Options) *Client {
+	baseURL := opt.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	httpClient := opt.HTTPClient
+	if httpClient == nil {
+		timeout := opt.Timeout
+		if timeout <= 0 {
+			timeout = time.Second * 10
+		}
+		httpClient = &http.Client{Timeout: timeout}
+	}
+	tokens := opt.TokenProvider
+	if tokens == nil {
+		tokens = StaticToken(opt.AccessToken)
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		tokens:     tokens,
+		httpClient: httpClient,
+	}
+}
+
+// URL 拼接接口地址，如 URL("youzan.items.onsale", "3.0.0", "get")
+func (c *Client) URL(api, version, method string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", c.baseURL, api, version, method)
+}
+
+// HTTPClient 调用接口使用的 http.Client，其它按 URL 拼接请求的地方也应该使用它
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Token 返回当前可用的 access_token
+func (c *Client) Token() (string, error) {
+	return c.tokens.Token()
+}
+
+// HandleTokenError 如果 b 是 token 失效的错误返回，使 token 失效以便下次重新获取，
+// 返回 true 表示可以换新的 token 重试，固定 token 无法刷新，总是返回 false
+func (c *Client) HandleTokenError(token string, b []byte) bool {
+	if !IsTokenError(b) {
+		return false
+	}
+	if _, ok := c.tokens.(staticToken); ok {
+		return false
+	}
+	c.tokens.Invalidate(token)
+	return true
+}
+
+// get 以 GET 方式调用接口，并把返回的 body 解析到 v，token 失效时刷新后重试一次
+func (c *Client) get(ctx context.Context, api, version, method string, params url.Values, v interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	for i := 0; ; i++ {
+		token, err := c.tokens.Token()
+		if err != nil {
+			return err
+		}
+		params.Set("access_token", token)
+		b, err := c.do(ctx, c.URL(api, version, method)+"?"+params.Encode())
+		if err != nil {
+			return err
+		}
+		if i == 0 && c.HandleTokenError(token, b) {
+			continue
+		}
+		if e := DecodeError(b); e != nil {
+			return e
+		}
+		return json.Unmarshal(b, v)
+	}
+}
+
+func (c *Client) do(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
@@ -0,0 +1,114 @@
+package youzan
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind 有赞错误的分类，决定调用方是重试、刷新 token 还是直接放弃
+type ErrorKind int
+
+const (
+	// ErrorKindPermanent 参数错误、商品不存在等，重试没有意义
+	ErrorKindPermanent ErrorKind = iota
+	// ErrorKindRetryable 有赞系统繁忙等临时错误
+	ErrorKindRetryable
+	// ErrorKindAuth access_token 无效或过期
+	ErrorKindAuth
+	// ErrorKindQuota 调用次数超过限制
+	ErrorKindQuota
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ErrorKindPermanent: "permanent",
+	ErrorKindRetryable: "retryable",
+	ErrorKindAuth:      "auth",
+	ErrorKindQuota:     "quota",
+}
+
+func (k ErrorKind) String() string {
+	return errorKindNames[k]
+}
+
+func (k ErrorKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// 有赞平台级错误码的分类，没有列出的按 Permanent 处理
+var (
+	AuthErrorCodes      = map[int]bool{40009: true, 40010: true}
+	QuotaErrorCodes     = map[int]bool{40013: true, 40014: true}
+	RetryableErrorCodes = map[int]bool{40000: true}
+)
+
+// Error 有赞接口返回的 error_response
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"msg"`
+	SubCode string `json:"sub_code,omitempty"`
+	SubMsg  string `json:"sub_msg,omitempty"`
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("youzan error [%d] %s", e.Code, e.Message)
+	if e.SubCode != "" || e.SubMsg != "" {
+		s += fmt.Sprintf(" (%s %s)", e.SubCode, e.SubMsg)
+	}
+	return s
+}
+
+func (e *Error) Kind() ErrorKind {
+	switch {
+	case AuthErrorCodes[e.Code]:
+		return ErrorKindAuth
+	case QuotaErrorCodes[e.Code]:
+		return ErrorKindQuota
+	case RetryableErrorCodes[e.Code], e.Code >= 50000:
+		return ErrorKindRetryable
+	case strings.Contains(e.Message, "繁忙"):
+		return ErrorKindRetryable
+	}
+	return ErrorKindPermanent
+}
+
+// Temporary 稍后重试可能成功的错误
+func (e *Error) Temporary() bool {
+	kind := e.Kind()
+	return kind == ErrorKindRetryable || kind == ErrorKindQuota
+}
+
+func (e *Error) MarshalJSON() ([]byte, error) {
+	type alias Error
+	return json.Marshal(&struct {
+		*alias
+		Kind ErrorKind `json:"kind"`
+	}{(*alias)(e), e.Kind()})
+}
+
+type errorEnvelope struct {
+	ErrorResponse *struct {
+		Code    int         `json:"code"`
+		Msg     string      `json:"msg"`
+		SubCode interface{} `json:"sub_code"`
+		SubMsg  string      `json:"sub_msg"`
+	} `json:"error_response"`
+}
+
+// DecodeError 解析接口返回的 body，有 error_response 时返回 *Error，否则返回 nil
+func DecodeError(b []byte) *Error {
+	env := &errorEnvelope{}
+	if err := json.Unmarshal(b, env); err != nil || env.ErrorResponse == nil {
+		return nil
+	}
+	er := env.ErrorResponse
+	e := &Error{
+		Code:    er.Code,
+		Message: er.Msg,
+		SubMsg:  er.SubMsg,
+	}
+	if er.SubCode != nil {
+		e.SubCode = fmt.Sprint(er.SubCode)
+	}
+	return e
+}
@@ -0,0 +1,139 @@
+package youzan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultTokenURL 获取 access_token 的地址
+const DefaultTokenURL = "https://open.youzan.com/oauth/token"
+
+// TokenProvider 提供调用接口用的 access_token
+type TokenProvider interface {
+	Token() (string, error)
+	// Invalidate 在 token 被有赞判定为无效时调用，只有 token 仍是当前 token 时才生效
+	Invalidate(token string)
+}
+
+type staticToken string
+
+// StaticToken 固定不变的 access_token
+func StaticToken(token string) TokenProvider {
+	return staticToken(token)
+}
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+func (t staticToken) Invalidate(token string) {}
+
+type SilentTokenOptions struct {
+	// TokenURL 默认为 DefaultTokenURL
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	// KdtID 授权店铺 ID
+	KdtID string
+	// HTTPClient 为空时使用 10s 超时的 http.Client
+	HTTPClient *http.Client
+	// RefreshBefore 提前多久刷新 token，默认 10 分钟
+	RefreshBefore time.Duration
+}
+
+// silentTokenProvider 自用型应用以 silent 方式获取 token，并缓存到过期前
+type silentTokenProvider struct {
+	opt        *SilentTokenOptions
+	httpClient *http.Client
+	token      string
+	expiresAt  time.Time
+	sync.Mutex
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Scope            string `json:"scope"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func NewSilentTokenProvider(opt *SilentTokenOptions) TokenProvider {
+	o := *opt
+	if o.TokenURL == "" {
+		o.TokenURL = DefaultTokenURL
+	}
+	if o.RefreshBefore <= 0 {
+		o.RefreshBefore = time.Minute * 10
+	}
+	httpClient := o.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: time.Second * 10}
+	}
+	return &silentTokenProvider{
+		opt:        &o,
+		httpClient: httpClient,
+	}
+}
+
+func (p *silentTokenProvider) Token() (string, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.token != "" && time.Now().Add(p.opt.RefreshBefore).Before(p.expiresAt) {
+		return p.token, nil
+	}
+	if err := p.refresh(); err != nil {
+		return "", err
+	}
+	return p.token, nil
+}
+
+func (p *silentTokenProvider) Invalidate(token string) {
+	p.Lock()
+	defer p.Unlock()
+	if p.token == token {
+		p.token = ""
+	}
+}
+
+func (p *silentTokenProvider) refresh() error {
+	res, err := p.httpClient.PostForm(p.opt.TokenURL, url.Values{
+		"client_id":     {p.opt.ClientID},
+		"client_secret": {p.opt.ClientSecret},
+		"grant_type":    {"silent"},
+		"kdt_id":        {p.opt.KdtID},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	tr := &tokenResponse{}
+	if err := json.Unmarshal(b, tr); err != nil {
+		return fmt.Errorf("解析 token 出错(%v), b: (%s)", err, string(b))
+	}
+	if tr.Error != "" {
+		return fmt.Errorf("获取 token 失败: %s %s", tr.Error, tr.ErrorDescription)
+	}
+	if tr.AccessToken == "" {
+		return errors.New("获取 token 失败: access_token 为空")
+	}
+	p.token = tr.AccessToken
+	p.expiresAt = time.Now().Add(time.Second * time.Duration(tr.ExpiresIn))
+	return nil
+}
+
+// IsTokenError 判断接口返回的 body 是否是 token 失效的错误
+func IsTokenError(b []byte) bool {
+	e := DecodeError(b)
+	return e != nil && e.Kind() == ErrorKindAuth
+}
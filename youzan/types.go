@@ -3,7 +3,10 @@ package youzan
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
+
+	"github.com/xuyuntech/inventory_sync_go/money"
 )
 
 var (
@@ -29,13 +32,13 @@ type GoodsDetail struct {
 }
 
 type GoodsSku struct {
-	OuterID            string  `json:"outer_id"`
-	SkuID              int64   `json:"sku_id"`
-	Quantity           float64 `json:"-"`
-	QuantityStr        string  `json:"quantity"`
-	Price              float64 `json:"-"`
-	PriceStr           string  `json:"price"`
-	PropertiesNameJSON string  `json:"properties_name_json"`
+	OuterID            string      `json:"outer_id"`
+	SkuID              int64       `json:"sku_id"`
+	Quantity           money.Stock `json:"-"`
+	QuantityStr        string      `json:"quantity"`
+	Price              money.Money `json:"-"`
+	PriceStr           string      `json:"price"`
+	PropertiesNameJSON string      `json:"properties_name_json"`
 }
 
 type GoodSkuProperty struct {
@@ -45,14 +48,28 @@ type GoodSkuProperty struct {
 	V   string `json:"v"`
 }
 
+// FormatProperties 解析 sku 的规格，没有规格的商品返回空列表
 func (gs *GoodsSku) FormatProperties() ([]*GoodSkuProperty, error) {
 	m := make([]*GoodSkuProperty, 0)
+	if strings.TrimSpace(gs.PropertiesNameJSON) == "" {
+		return m, nil
+	}
 	if err := json.Unmarshal([]byte(gs.PropertiesNameJSON), &m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+func (o *Offlines) GetByID(id string) (*Offline, error) {
+	id = strings.TrimSpace(id)
+	for _, offline := range o.Items {
+		if offline.OfflineID == id {
+			return offline, nil
+		}
+	}
+	return nil, ErrOfflineNotFound
+}
+
 func (o *Offlines) GetIDByName(name string) (string, error) {
 	for _, offline := range o.Items {
 		if strings.Trim(offline.Name, " ") == strings.Trim(name, " ") {
@@ -64,7 +81,24 @@ func (o *Offlines) GetIDByName(name string) (string, error) {
 
 // Item 有赞商品信息
 type Item struct {
-	ItemID int64  `json:"item_id"`
-	Title  string `json:"title"`
-	ItemNO string `json:"item_no"`
+	ItemID int64      `json:"item_id"`
+	Title  string     `json:"title"`
+	ItemNO string     `json:"item_no"`
+	Tags   []*ItemTag `json:"item_tags"`
+}
+
+// ItemTag 商品分组
+type ItemTag struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// HasTag 按分组名称或分组 ID 判断商品是否在分组里
+func (i *Item) HasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t.Name == tag || fmt.Sprintf("%d", t.ID) == tag {
+			return true
+		}
+	}
+	return false
 }
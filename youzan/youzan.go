@@ -1,17 +1,14 @@
 package youzan
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"time"
+	"net/url"
+	"sync"
 
-	"github.com/cabernety/gopkg/httplib"
 	"golang.org/x/sync/errgroup"
 )
 
-var AccessToken = "ada91d8aa9773da2ab29c773ae247819"
-
 type itemResponse struct {
 	Response struct {
 		Count int     `json:"count"`
@@ -32,50 +29,36 @@ type offlineItemResponse struct {
 	} `json:"response"`
 }
 
-func queryItems(pageNo int, pageSize int, api string) ([]*Item, error) {
-	response := &itemResponse{}
-	res, err := httplib.Get(fmt.Sprintf("https://open.youzan.com/api/oauthentry/%s/3.0.0/get", api)).
-		Param("access_token", AccessToken).
-		Param("page_no", fmt.Sprintf("%d", pageNo)).
-		Param("page_size", fmt.Sprintf("%d", pageSize)).
-		SetTimeout(time.Second*10, time.Second*10).Response()
-	if err != nil {
-		return nil, err
+func pageParams(pageNo int, pageSize int) url.Values {
+	return url.Values{
+		"page_no":   {fmt.Sprintf("%d", pageNo)},
+		"page_size": {fmt.Sprintf("%d", pageSize)},
 	}
-	b, _ := ioutil.ReadAll(res.Body)
-	if err := json.Unmarshal(b, response); err != nil {
+}
+
+func (c *Client) queryItems(ctx context.Context, pageNo int, pageSize int, api string) ([]*Item, error) {
+	response := &itemResponse{}
+	if err := c.get(ctx, api, "3.0.0", "get", pageParams(pageNo, pageSize), response); err != nil {
 		return nil, err
 	}
-	// if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
-	// 	return nil, err
-	// }
 	return response.Response.Items, nil
 }
 
-func queryOfflines(pageNo int, pageSize int) ([]*Offline, error) {
+func (c *Client) queryOfflines(ctx context.Context, pageNo int, pageSize int) ([]*Offline, error) {
 	response := &offlineResponse{}
-	res, err := httplib.Get(fmt.Sprintf("https://open.youzan.com/api/oauthentry/youzan.multistore.offline/3.0.0/search")).
-		Param("access_token", AccessToken).
-		Param("page_no", fmt.Sprintf("%d", pageNo)).
-		Param("page_size", fmt.Sprintf("%d", pageSize)).
-		SetTimeout(time.Second*10, time.Second*10).Response()
-	if err != nil {
-		return nil, err
-	}
-	b, _ := ioutil.ReadAll(res.Body)
-	if err := json.Unmarshal(b, response); err != nil {
+	if err := c.get(ctx, "youzan.multistore.offline", "3.0.0", "search", pageParams(pageNo, pageSize), response); err != nil {
 		return nil, err
 	}
 	return response.Response.List, nil
 }
 
-func QueryOfflines() (*Offlines, error) {
+func (c *Client) QueryOfflines(ctx context.Context) (*Offlines, error) {
 	offlines := &Offlines{}
 	results := make([]*Offline, 0)
 	pageNo := 1
 	pageSize := 100
 	for {
-		offlines, err := queryOfflines(pageNo, pageSize)
+		offlines, err := c.queryOfflines(ctx, pageNo, pageSize)
 		if err != nil {
 			return nil, err
 		}
@@ -90,40 +73,30 @@ func QueryOfflines() (*Offlines, error) {
 }
 
 // QueryItems 获取出售中和仓库中的所有商品
-func QueryItems() ([]*Item, error) {
+func (c *Client) QueryItems(ctx context.Context) ([]*Item, error) {
 	results := make([]*Item, 0)
-	var g errgroup.Group
-	g.Go(func() error {
-		pageNo := 1
-		pageSize := 100
-		for {
-			items, err := queryItems(pageNo, pageSize, "youzan.items.onsale")
-			if err != nil {
-				return err
+	var mu sync.Mutex
+	g, ctx := errgroup.WithContext(ctx)
+	for _, api := range []string{"youzan.items.onsale", "youzan.items.inventory"} {
+		api := api
+		g.Go(func() error {
+			pageNo := 1
+			pageSize := 100
+			for {
+				items, err := c.queryItems(ctx, pageNo, pageSize, api)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				results = append(results, items...)
+				mu.Unlock()
+				if len(items) < pageSize {
+					return nil
+				}
+				pageNo++
 			}
-			results = append(results, items...)
-			if len(items) < pageSize {
-				return nil
-			}
-			pageNo++
-		}
-	})
-
-	g.Go(func() error {
-		pageNo := 1
-		pageSize := 100
-		for {
-			items, err := queryItems(pageNo, pageSize, "youzan.items.inventory")
-			if err != nil {
-				return err
-			}
-			results = append(results, items...)
-			if len(items) < pageSize {
-				return nil
-			}
-			pageNo++
-		}
-	})
+		})
+	}
 
 	if err := g.Wait(); err != nil {
 		return nil, err